@@ -0,0 +1,125 @@
+package kaleidoscope
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// WriteASTJSON drains in, writing each top-level AST to w as an element
+// of a JSON array. Every node is an object with its Go type's name under
+// "type" (e.g. "ifNode"), its position under "pos" and its fields, with
+// sub-nodes as nested objects. Like WriteTokensJSON, the trees are
+// written as they arrive.
+func WriteASTJSON(w io.Writer, in <-chan node) error {
+	sep := "["
+	for n := range in {
+		b, err := json.Marshal(astJSON(n))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\n%s", sep, b); err != nil {
+			return err
+		}
+		sep = ","
+	}
+	if sep == "[" { // no statements at all
+		_, err := fmt.Fprintln(w, "[]")
+		return err
+	}
+	_, err := fmt.Fprintln(w, "\n]")
+	return err
+}
+
+// astJSON returns the tree rooted at n as a value that encodes to the
+// JSON described by WriteASTJSON. Absent optional sub-nodes are null.
+func astJSON(n node) interface{} {
+	if n == nil || reflect.ValueOf(n).IsNil() {
+		return nil
+	}
+	o := map[string]interface{}{
+		"type": reflect.TypeOf(n).Elem().Name(),
+		"pos":  int(n.Position()),
+	}
+	list := func(nodes []node) []interface{} {
+		l := []interface{}{}
+		for _, n := range nodes {
+			l = append(l, astJSON(n))
+		}
+		return l
+	}
+
+	switch n := n.(type) {
+	case *numberNode:
+		o["value"] = n.val
+	case *integerNode:
+		o["value"] = n.val
+	case *rationalNode:
+		o["num"], o["den"] = n.num, n.den
+	case *stringNode:
+		o["value"] = n.val
+	case *boolNode:
+		o["value"] = n.val
+	case *ifNode:
+		o["cond"], o["then"], o["else"] = astJSON(n.ifN), astJSON(n.thenN), astJSON(n.elseN)
+	case *forNode:
+		o["counter"] = n.counter
+		o["start"], o["test"], o["step"] = astJSON(n.start), astJSON(n.test), astJSON(n.step)
+		o["body"], o["result"] = astJSON(n.body), astJSON(n.result)
+	case *whileNode:
+		o["cond"], o["body"] = astJSON(n.cond), astJSON(n.body)
+	case *doWhileNode:
+		o["body"], o["cond"] = astJSON(n.body), astJSON(n.cond)
+	case *unaryNode:
+		o["op"], o["operand"] = n.name, astJSON(n.operand)
+	case *binaryNode:
+		o["op"], o["left"], o["right"] = n.op, astJSON(n.left), astJSON(n.right)
+	case *fnCallNode:
+		o["callee"], o["args"] = n.callee, list(n.args)
+	case *variableNode:
+		o["name"] = n.name
+	case *indexNode:
+		o["name"], o["index"] = n.name, astJSON(n.index)
+	case *variableExprNode:
+		vars := []interface{}{}
+		for _, v := range n.vars {
+			vars = append(vars, map[string]interface{}{"name": v.name, "init": astJSON(v.node), "size": v.size})
+		}
+		o["vars"], o["body"] = vars, astJSON(n.body)
+	case *nestedFnNode:
+		o["fn"], o["body"] = astJSON(n.fn), astJSON(n.body)
+	case *lambdaNode:
+		o["fn"] = astJSON(n.fn)
+	case *blockNode:
+		o["exprs"] = list(n.exprs)
+	case *returnNode:
+		o["value"] = astJSON(n.value)
+	case *incDecNode:
+		o["op"], o["prefix"], o["name"] = n.op, n.prefix, n.name
+	case *fnPrototypeNode:
+		args := []interface{}{}
+		for i, a := range n.args {
+			args = append(args, map[string]interface{}{"name": a, "type": n.argTypes[i]})
+		}
+		o["name"], o["args"], o["returnType"] = n.name, args, n.retType
+		if n.isOperator {
+			o["operator"], o["precedence"] = true, n.precedence
+		}
+	case *functionNode:
+		o["proto"], o["body"], o["discard"] = astJSON(n.proto), astJSON(n.body), n.discard
+	case *enumNode:
+		members := []interface{}{}
+		for _, m := range n.members {
+			members = append(members, map[string]interface{}{"name": m.name, "value": m.value})
+		}
+		o["name"], o["members"] = n.name, members
+	case *globalVarNode:
+		vars := []interface{}{}
+		for _, v := range n.vars {
+			vars = append(vars, map[string]interface{}{"name": v.name, "init": astJSON(v.node), "size": v.size})
+		}
+		o["vars"] = vars
+	}
+	return o
+}
@@ -0,0 +1,257 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Check parses the inputs and resolves the names they use without
+// generating any code, reporting each variable, function or operator
+// that isn't in scope where it's used. As when the program is run,
+// names must be defined before the statements that use them, unless the
+// Engine's WholeProgram option is set; those checked by earlier calls
+// to Check remain in scope. It returns an error if there were any
+// syntax errors or undefined names.
+func (e *Engine) Check(inputs ...Input) error {
+	var roots []node
+	e.diags.reset()
+	for n := range parse(e.lex(inputs).Tokens(), e.opts, e.operators, e.diags) {
+		roots = append(roots, n)
+	}
+	syntax := e.diags.syntaxErrors()
+
+	r := e.resolver
+	if e.opts.WholeProgram {
+		for _, n := range roots {
+			r.declare(n)
+		}
+	}
+	undefined := r.undefined
+	for _, n := range roots {
+		r.declare(n)
+		r.resolve(n)
+	}
+
+	switch undefined = r.undefined - undefined; {
+	case syntax > 0 && undefined > 0:
+		return fmt.Errorf("%d syntax error(s) and %d undefined name(s)", syntax, undefined)
+	case syntax > 0:
+		return fmt.Errorf("%d syntax error(s)", syntax)
+	case undefined > 0:
+		return fmt.Errorf("%d undefined name(s)", undefined)
+	}
+	return nil
+}
+
+// resolver checks that the names used by the AST are in scope.
+// Variables and functions have separate namespaces, as in codegen.
+type resolver struct {
+	funcs   map[string]bool // top-level functions and operators, e.g. "binary!"
+	globals map[string]bool // global variables and enum members
+
+	// locals in scope, innermost last. Nested functions can see their
+	// enclosing function's variables, which they capture, and call the
+	// functions nested in it.
+	vars       []scope
+	localFuncs []map[string]bool
+
+	undefined  int  // the number of undefined names reported
+	quiet      bool // count undefined names without reporting them
+	warnUnused bool // warn about locals that are never used as their scopes end
+
+	diags *diagnosticLog // collects the errors and warnings reported, if non-nil
+}
+
+// scope maps the names of the locals declared in a scope to them.
+type scope map[string]*local
+
+// local is a variable or parameter.
+type local struct {
+	kind string // "variable" or "parameter"
+	pos  Pos
+	used bool
+}
+
+func newResolver() *resolver {
+	r := &resolver{funcs: map[string]bool{}, globals: map[string]bool{}}
+	for name := range builtins {
+		r.funcs[name] = true
+	}
+	return r
+}
+
+// declare adds the names defined by the top-level statement n.
+func (r *resolver) declare(n node) {
+	switch n := n.(type) {
+	case *fnPrototypeNode:
+		r.funcs[n.name] = true
+	case *functionNode:
+		if name := n.proto.(*fnPrototypeNode).name; name != "" {
+			r.funcs[name] = true
+		}
+	case *globalVarNode:
+		for _, v := range n.vars {
+			r.globals[v.name] = true
+		}
+	case *enumNode:
+		for _, m := range n.members {
+			r.globals[m.name] = true
+		}
+	}
+}
+
+// resolve reports the undefined names used in the tree rooted at n.
+func (r *resolver) resolve(n node) {
+	switch n := n.(type) {
+	case nil:
+	case *variableNode:
+		if !r.isVar(n.name) && !r.isFunc(n.name) { // a function's name is its value
+			r.errorf(errUnknownVariable, n.Pos, "undefined variable %s", n.name)
+		}
+	case *incDecNode:
+		r.resolveVar(n.Pos, n.name)
+	case *indexNode:
+		r.resolveVar(n.Pos, n.name)
+		r.resolve(n.index)
+	case *fnCallNode:
+		if !r.isFunc(n.callee) && !r.isVar(n.callee) { // a variable may hold a function
+			r.errorf(errUnknownFunction, n.Pos, "undefined function %s", n.callee)
+		}
+		for _, a := range n.args {
+			r.resolve(a)
+		}
+	case *unaryNode:
+		if n.name != "-" && !r.isFunc("unary"+n.name) {
+			r.errorf(errUnknownFunction, n.Pos, "undefined operator unary%s", n.name)
+		}
+		r.resolve(n.operand)
+	case *binaryNode:
+		if _, ok := builtinPrecedence[n.op]; !ok && !r.isFunc("binary"+n.op) {
+			r.errorf(errUnknownFunction, n.Pos, "undefined operator binary%s", n.op)
+		}
+		r.resolve(n.left)
+		r.resolve(n.right)
+	case *variableExprNode:
+		// declarations in blocks last until the block's end.
+		if n.body != nil {
+			r.push()
+			defer r.pop()
+		}
+		for _, v := range n.vars {
+			r.resolve(v.node)
+			r.vars[len(r.vars)-1][v.name] = &local{kind: "variable", pos: n.Pos}
+		}
+		r.resolve(n.body)
+	case *forNode:
+		r.resolve(n.start)
+		r.push()
+		r.vars[len(r.vars)-1][n.counter] = &local{kind: "variable", pos: n.Pos, used: true} // counters needn't be
+		for _, c := range []node{n.test, n.step, n.body, n.result} {
+			r.resolve(c)
+		}
+		r.pop()
+	case *blockNode:
+		r.push()
+		for _, e := range n.exprs {
+			r.resolve(e)
+		}
+		r.pop()
+	case *nestedFnNode:
+		fn := n.fn.(*functionNode)
+		r.localFuncs = append(r.localFuncs, map[string]bool{fn.proto.(*fnPrototypeNode).name: true})
+		outer := r.vars
+		r.vars = append(outer[:len(outer):len(outer)], params(fn))
+		r.resolve(fn.body)
+		r.reportUnused(r.vars[len(r.vars)-1])
+		r.vars = outer
+		r.resolve(n.body)
+		r.localFuncs = r.localFuncs[:len(r.localFuncs)-1]
+	case *lambdaNode:
+		outer := r.vars
+		r.resolveFunction(n.fn.(*functionNode))
+		r.vars = outer
+	case *functionNode:
+		r.resolveFunction(n)
+	default:
+		for _, c := range children(n) {
+			r.resolve(c)
+		}
+	}
+}
+
+// resolveFunction resolves the body of fn, a top-level function or a
+// lambda, in which only its parameters are local variables.
+func (r *resolver) resolveFunction(fn *functionNode) {
+	r.vars = []scope{params(fn)}
+	r.resolve(fn.body)
+	r.reportUnused(r.vars[0])
+}
+
+func params(fn *functionNode) scope {
+	proto := fn.proto.(*fnPrototypeNode)
+	params := scope{}
+	for _, a := range proto.args {
+		params[a] = &local{kind: "parameter", pos: proto.Pos}
+	}
+	return params
+}
+
+func (r *resolver) resolveVar(pos Pos, name string) {
+	if !r.isVar(name) {
+		r.errorf(errUnknownVariable, pos, "undefined variable %s", name)
+	}
+}
+
+// isVar reports whether name is a variable in scope, marking it used.
+func (r *resolver) isVar(name string) bool {
+	for i := len(r.vars) - 1; i >= 0; i-- {
+		if l := r.vars[i][name]; l != nil {
+			l.used = true
+			return true
+		}
+	}
+	return r.globals[name]
+}
+
+func (r *resolver) isFunc(name string) bool {
+	for _, s := range r.localFuncs {
+		if s[name] {
+			return true
+		}
+	}
+	return r.funcs[name]
+}
+
+func (r *resolver) push() { r.vars = append(r.vars, scope{}) }
+
+func (r *resolver) pop() {
+	r.reportUnused(r.vars[len(r.vars)-1])
+	r.vars = r.vars[:len(r.vars)-1]
+}
+
+// reportUnused warns about the locals in s that were never used, if
+// warnUnused is set.
+func (r *resolver) reportUnused(s scope) {
+	if !r.warnUnused {
+		return
+	}
+	var names []string
+	for name, l := range s {
+		if !l.used {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.diags.warning(fmt.Sprintf("%s %s declared at %v is never used", s[name].kind, name, s[name].pos))
+	}
+}
+
+func (r *resolver) errorf(code string, pos Pos, format string, args ...interface{}) {
+	r.undefined++
+	if !r.quiet {
+		msg := fmt.Sprintf(format, args...)
+		r.diags.report(Diagnostic{Pos: pos, Severity: SeverityError, Code: code, Message: msg},
+			fmt.Sprintf("Error[%v] at %v: %v\n", code, pos, msg))
+	}
+}
@@ -0,0 +1,63 @@
+package kaleidoscope
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCheck checks that undefined names are reported without running
+// anything, that names checked earlier stay in scope, and that
+// WholeProgram allows a use before the definition.
+func TestCheck(t *testing.T) {
+	check := func(e *Engine, src string) error {
+		return e.Check(Input{"check.k", strings.NewReader(src)})
+	}
+	e := newTestEngine(t, Options{})
+	if err := check(e, "def f(x) x + y\ng(1)"); err == nil || err.Error() != "2 undefined name(s)" {
+		t.Errorf("got %v, want 2 undefined names", err)
+	}
+	if err := check(e, "def g(x) x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(e, "g(2)"); err != nil {
+		t.Errorf("g is undefined after an earlier Check: %v", err)
+	}
+	if err := check(e, "def (x) x"); err == nil || err.Error() != "1 syntax error(s)" {
+		t.Errorf("got %v, want a syntax error", err)
+	}
+	if err := check(e, "later(1)\ndef later(x) x"); err == nil {
+		t.Errorf("a call before the definition was accepted")
+	}
+	whole := newTestEngine(t, Options{WholeProgram: true})
+	if err := check(whole, "later(1)\ndef later(x) x"); err != nil {
+		t.Errorf("with WholeProgram, got %v", err)
+	}
+}
+
+// TestWarnUnused checks that with WarnUnused, a parameter and a
+// variable that are never used are warned about, with where they're
+// declared, and that otherwise they aren't.
+func TestWarnUnused(t *testing.T) {
+	const src = "def f(x, y) var z = 1 in x"
+	for _, warn := range []bool{false, true} {
+		e := newTestEngine(t, Options{WarnUnused: warn})
+		if err := e.Check(Input{"unused.k", strings.NewReader(src)}); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range e.Diagnostics() {
+			if d.Severity != SeverityWarning {
+				t.Errorf("got %v, want only warnings", d)
+			}
+			got = append(got, d.Message)
+		}
+		var want []string
+		if warn {
+			want = []string{"variable z declared at 12 is never used", "parameter y declared at 4 is never used"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("with WarnUnused %v, got %q, want %q", warn, got, want)
+		}
+	}
+}
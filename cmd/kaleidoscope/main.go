@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ajsnow/kaleidoscope"
+)
+
+var (
+	batch       = flag.Bool("b", false, "batch (non-interactive) mode")
+	optimized   = flag.Bool("opt", true, "add some optimization passes (-opt=false is the same as -O0)")
+	printTokens = flag.Bool("tok", false, "print tokens")
+	tokensJSON  = flag.Bool("tokens-json", false, "print tokens as a JSON array instead of running the program")
+	printAst    = flag.Bool("ast", false, "print abstract syntax tree")
+	check       = flag.Bool("check", false, "report undefined variables and functions without generating or running any code")
+	astJSON     = flag.Bool("ast-json", false, "print the abstract syntax tree of each statement as a JSON array instead of running the program")
+	printLLVMIR = flag.Bool("llvm", false, "print LLVM generated code")
+	peephole    = flag.Bool("peephole", true, "simplify expressions such as x * 1 before generating code")
+	unsafePeep  = flag.Bool("unsafe-peephole", false, "also simplify x + 0 and x * 0, which changes results for -0, NaN and infinities")
+	objectFile  = flag.String("c", "", "compile to a native object `file` instead of running; 'def main(): int' is the entry point")
+	emitLLVM    = flag.String("emit-llvm", "", "write the IR of every function to `file` at the end of the run (only those main calls, if there's a main)")
+	emitBC      = flag.String("emit-bc", "", "write the bitcode of every function to `file` at the end of the run (only those main calls, if there's a main)")
+	emitBoth    = flag.String("emit-llvm-both", "", "write the IR before and after optimization to `base`.unopt.ll and base.opt.ll")
+	requireSemi = flag.Bool("require-semicolons", false, "require ';' after each top-level statement")
+	maxLine     = flag.Int("max-line", 0, "longest input line in bytes (0 for the 64KB default)")
+	encoding    = flag.String("encoding", "", "character encoding of the input files, e.g. latin1 (default UTF-8)")
+	explain     = flag.String("explain", "", "print a detailed explanation of an error code, e.g. E001")
+	profile     = flag.Bool("profile", false, "print the time spent lexing, parsing, generating and running code")
+	wholeProg   = flag.Bool("whole-program", false, "read all input before running so functions may be used before their definitions")
+	serial      = flag.Bool("serial", false, "lex and parse all input before running it, so dumps and results aren't interleaved (use with -b)")
+	timeStmts   = flag.Bool("time", false, "print the time spent generating and running each statement, and setting up optimization")
+	printStats  = flag.Bool("stats", false, "print counts of the functions, blocks and instructions generated")
+	selfTest    = flag.Bool("self-test", false, "run a built-in smoke test of the compiler and JIT")
+	decimalSep  = flag.String("decimal-sep", ".", "decimal separator used when printing results, e.g. ','")
+	groupSep    = flag.String("group-sep", "", "digit grouping separator used when printing results, e.g. '.'")
+	werror      = flag.Bool("Werror", false, "treat warnings as errors, failing the run if any are reported")
+	warnUnused  = flag.Bool("warn-unused", false, "warn about variables and parameters that are never used")
+	boundsCheck = flag.Bool("bounds-check", false, "abort if an array index is out of range, at some cost in speed")
+	trapDivZero = flag.Bool("trap-divzero", false, "abort on division by zero instead of producing infinity or NaN, at some cost in speed")
+	intWidth    = flag.Int("int-width", 64, "the number of bits in an int: 8, 16, 32 or 64")
+	precedence  = flag.String("prec", "", "override the precedences of built-in binary operators, e.g. \"+=15,*=50\"")
+	stackGuard  = flag.Int("stack-guard", 0, "fail any expression that nests calls more than this deep, instead of crashing (0 for no limit)")
+	timeout     = flag.Duration("timeout", 0, "abandon any top-level expression that runs longer than this, e.g. 5s (0 for no limit)")
+)
+
+// optLevels are the -O0 to -O3 flags, indexed by level.
+var optLevels = [...]*bool{
+	flag.Bool("O0", false, "don't optimize"),
+	flag.Bool("O1", false, "optimize a little: promote variables to registers and simplify instructions"),
+	flag.Bool("O2", false, "optimize as -O1, and reassociate expressions, eliminate redundancy and turn tail recursion into loops (the default)"),
+	flag.Bool("O3", false, "optimize as -O2, and unroll loops and inline functions"),
+}
+
+func main() {
+	flag.Parse()
+	if *explain != "" {
+		e, ok := kaleidoscope.Explain(*explain)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no explanation for error code %s\n", *explain)
+			os.Exit(-1)
+		}
+		fmt.Print(e)
+		return
+	}
+
+	prec, err := kaleidoscope.ParsePrecedences(*precedence)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+
+	opts := kaleidoscope.Options{
+		OptLevel:          optLevel(),
+		WarningsAsErrors:  *werror,
+		WarnUnused:        *warnUnused,
+		PrintTokens:       *printTokens,
+		PrintAST:          *printAst,
+		RequireSemicolons: *requireSemi,
+		MaxLineLength:     *maxLine,
+		Encoding:          *encoding,
+		PrintLLVMIR:       *printLLVMIR,
+		Peephole:          *peephole,
+		UnsafePeephole:    *unsafePeep,
+		ObjectFile:        *objectFile,
+		EmitLLVM:          *emitLLVM,
+		EmitBitcode:       *emitBC,
+		EmitLLVMBoth:      strings.TrimSuffix(*emitBoth, ".ll"),
+		WholeProgram:      *wholeProg,
+		Serial:            *serial,
+		Time:              *timeStmts,
+		DecimalSep:        *decimalSep,
+		GroupSep:          *groupSep,
+		BoundsCheck:       *boundsCheck,
+		TrapDivZero:       *trapDivZero,
+		Redefine:          !*batch,
+		Memoize:           !*batch,
+		Precedence:        prec,
+		IntWidth:          *intWidth,
+		StackGuard:        *stackGuard,
+		Timeout:           *timeout,
+	}
+	if *profile {
+		opts.Profile = &kaleidoscope.Profile{}
+	}
+	if *printStats {
+		opts.Stats = &kaleidoscope.Stats{}
+	}
+	engine, err := kaleidoscope.NewEngine(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+
+	if *selfTest {
+		if !engine.SelfTest(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// command line filenames, then stdin
+	var inputs []kaleidoscope.Input
+	for _, fn := range flag.Args() {
+		f, err := os.Open(fn)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
+		inputs = append(inputs, kaleidoscope.Input{Name: f.Name(), R: f})
+	}
+	if !*batch {
+		inputs = append(inputs, kaleidoscope.Input{Name: os.Stdin.Name(), R: newREPLReader(os.Stdin, os.Stdout, engine)})
+	}
+
+	if *tokensJSON {
+		if err := engine.WriteTokensJSON(os.Stdout, inputs...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
+		return
+	}
+	if *astJSON {
+		if err := engine.WriteASTJSON(os.Stdout, inputs...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if *check {
+		if err := engine.Check(inputs...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = engine.Interpret(inputs...)
+	if opts.Profile != nil {
+		opts.Profile.Report(os.Stderr)
+	}
+	if opts.Stats != nil {
+		opts.Stats.Report(os.Stderr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// optLevel returns the optimization level chosen by the -O flags, the
+// highest given if there are several. It defaults to 2.
+func optLevel() int {
+	if !*optimized {
+		return 0
+	}
+	level := 2
+	for l, set := range optLevels {
+		if *set {
+			level = l
+		}
+	}
+	return level
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ajsnow/kaleidoscope"
+	"github.com/peterh/liner"
+)
+
+// historyFile is where the REPL's history is kept between sessions,
+// relative to the user's home directory.
+const historyFile = ".kaleidoscope_history"
+
+// replReader passes the statements read from its input on to the
+// lexer, a statement at a time, reading more lines while they're
+// incomplete. On a terminal, lines are read with a line editor, with
+// history that persists across sessions. REPL commands given in place
+// of a statement are run instead, writing what they print to its
+// output:
+//
+//	:functions  lists the functions defined so far
+//	:quit       ends the input, as EOF does
+type replReader struct {
+	engine  *kaleidoscope.Engine
+	editor  *liner.State  // nil if the input isn't a terminal
+	in      *bufio.Reader // used without an editor; shared with getchard for stdin
+	out     io.Writer     // where REPL commands print
+	stmt    []byte        // the lines of the incomplete statement read so far
+	pending []byte        // the rest of the statement being read by the lexer
+	quit    bool
+}
+
+func newREPLReader(in io.Reader, out io.Writer, engine *kaleidoscope.Engine) *replReader {
+	r := &replReader{engine: engine, out: out}
+	if f, ok := in.(*os.File); !ok || !isTerminal(f) || !liner.TerminalSupported() {
+		r.in = bufio.NewReader(in)
+		if in == io.Reader(os.Stdin) {
+			r.in = kaleidoscope.Stdin
+		}
+		return r
+	}
+	r.editor = liner.NewLiner()
+	r.editor.SetCtrlCAborts(true)
+	if h, err := os.Open(historyPath()); err == nil {
+		r.editor.ReadHistory(h)
+		h.Close()
+	}
+	return r
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *replReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.quit {
+			r.close()
+			return 0, io.EOF
+		}
+		line, err := r.readLine()
+		if err == liner.ErrPromptAborted {
+			r.stmt = nil // ^C discards the statement being entered
+			continue
+		}
+		if len(line) == 0 && err != nil {
+			if len(r.stmt) == 0 {
+				r.close()
+				return 0, err
+			}
+			// hand on the unfinished statement for the parser to report.
+			r.pending, r.stmt = r.stmt, nil
+			continue
+		}
+		if len(r.stmt) == 0 && r.command(strings.TrimSpace(line)) {
+			continue
+		}
+		r.stmt = append(r.stmt, line...)
+		if err != nil || !kaleidoscope.Incomplete(string(r.stmt)) {
+			r.pending, r.stmt = r.stmt, nil
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readLine reads the next line, including its newline, prompting for
+// it if there's an editor.
+func (r *replReader) readLine() (string, error) {
+	if r.editor == nil {
+		return r.in.ReadString('\n')
+	}
+	prompt := "ready> "
+	if len(r.stmt) > 0 {
+		prompt = "  ...> "
+	}
+	line, err := r.editor.Prompt(prompt)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(line) != "" {
+		r.editor.AppendHistory(line)
+	}
+	return line + "\n", nil
+}
+
+// close ends the input, saving the history and restoring the terminal
+// if there's an editor.
+func (r *replReader) close() {
+	r.quit = true
+	if r.editor == nil {
+		return
+	}
+	if h, err := os.Create(historyPath()); err == nil {
+		r.editor.WriteHistory(h)
+		h.Close()
+	}
+	r.editor.Close()
+	r.editor = nil
+}
+
+// historyPath returns the path of the history file.
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return historyFile
+	}
+	return filepath.Join(home, historyFile)
+}
+
+// command runs cmd if it's a REPL command, reporting whether it was.
+func (r *replReader) command(cmd string) bool {
+	switch cmd {
+	case ":functions":
+		for _, f := range r.engine.Functions() {
+			if f.Extern {
+				fmt.Fprintf(r.out, "extern %s/%d\n", f.Name, f.Params)
+			} else {
+				fmt.Fprintf(r.out, "%s/%d\n", f.Name, f.Params)
+			}
+		}
+	case ":quit":
+		r.quit = true
+	default:
+		return false
+	}
+	return true
+}
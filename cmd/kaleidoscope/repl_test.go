@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ajsnow/kaleidoscope"
+)
+
+// newTestREPL returns a REPL reader of input for a new engine, and the
+// buffer its commands print to.
+func newTestREPL(t *testing.T, input string) (*replReader, *bytes.Buffer) {
+	t.Helper()
+	engine, err := kaleidoscope.NewEngine(kaleidoscope.Options{QuietDiagnostics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	return newREPLReader(strings.NewReader(input), &out, engine), &out
+}
+
+func TestREPLFunctions(t *testing.T) {
+	r, out := newTestREPL(t, "extern cos(x)\ndef sq(x) x * x\n:functions\n")
+	if err := r.engine.Interpret(kaleidoscope.Input{Name: "stdin", R: r}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"extern cos/1\n", "sq/1\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf(":functions printed %q, want a line %q", out.String(), want)
+		}
+	}
+}
+
+func TestREPLQuit(t *testing.T) {
+	r, _ := newTestREPL(t, "1 + 2\n:quit\n3 + 4\n")
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1 + 2\n"; string(got) != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+// statements returns what each Read of r gives until the end of its
+// input.
+func statements(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var stmts []string
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			stmts = append(stmts, string(buf[:n]))
+		}
+		if err == io.EOF {
+			return stmts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestREPLContinuation(t *testing.T) {
+	r, _ := newTestREPL(t, "def f(x)\n  x +\n  1\n(1 +\n2)\n{\n3 }\nf(1)\ndef g(x)\n")
+	want := []string{"def f(x)\n  x +\n  1\n", "(1 +\n2)\n", "{\n3 }\n", "f(1)\n", "def g(x)\n"}
+	if got := statements(t, r); !reflect.DeepEqual(got, want) {
+		t.Errorf("read statements %q, want %q", got, want)
+	}
+}
+
+// TestREPLRecovery checks that an error in one statement, including
+// one left unfinished at the end of the input, doesn't keep the
+// statements after it from being parsed.
+func TestREPLRecovery(t *testing.T) {
+	r, _ := newTestREPL(t, "def (x) x\ndef g(x) x\ng(1)\n1 + \"\\q\"\ng(2)\ndef h(x)\n")
+	err := r.engine.Check(kaleidoscope.Input{Name: "stdin", R: r})
+	// g is defined, or its calls would be undefined names too.
+	if err == nil || err.Error() != "3 syntax error(s)" {
+		t.Errorf("got %v, want 3 syntax errors: %v", err, r.engine.Diagnostics())
+	}
+}
+
+// TestREPLWithoutTerminal checks that input that isn't a terminal, as
+// with a pipe, is read without the line editor: nothing is prompted
+// for and no history is kept.
+func TestREPLWithoutTerminal(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	r, out := newTestREPL(t, "1 + 2\n")
+	if r.editor != nil {
+		t.Fatal("the line editor is used for input that isn't a terminal")
+	}
+	if got := statements(t, r); !reflect.DeepEqual(got, []string{"1 + 2\n"}) {
+		t.Errorf("read %q, want the one statement", got)
+	}
+	if out.Len() != 0 {
+		t.Errorf("printed %q, want nothing", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(home, historyFile)); !os.IsNotExist(err) {
+		t.Errorf("history was written: %v", err)
+	}
+}
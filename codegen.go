@@ -1,350 +1,1657 @@
-package main
+package kaleidoscope
 
 import (
+	"bytes"
 	"fmt"
-	"os"
 
 	"github.com/ajsnow/llvm"
 )
 
-var (
-	rootModule             = llvm.NewModule("root")
-	rootFuncPassMgr        = llvm.NewFunctionPassManagerForModule(rootModule)
-	nativeInitErr          = llvm.InitializeNativeTarget()
-	execEngine, jitInitErr = llvm.NewJITCompiler(rootModule, 0)
-	builder                = llvm.NewBuilder()
-	namedVals              = map[string]llvm.Value{}
-)
+// genContext holds the state of code generation for one Engine: the
+// LLVM context and module that code is generated into, the JIT that
+// runs it, and the symbol tables of the code generated so far. Nothing
+// in it is shared, so separate genContexts may be used concurrently.
+type genContext struct {
+	*diagnosticLog // collects the errors and warnings reported; see errorV
+
+	context         llvm.Context
+	module          llvm.Module
+	funcPassMgr     llvm.PassManager
+	modPassMgr      llvm.PassManager
+	runModulePasses bool // modPassMgr has passes to run; see optimizeModule
+	moduleChanged   bool // functions were defined since modPassMgr last ran
+	execEngine      llvm.ExecutionEngine
+	builder         llvm.Builder
+	namedVals       map[string]llvm.Value       // maps the names of locals to their allocas
+	globalVals      map[string]llvm.Value       // maps the names of global variables to their globals
+	localFuncs      map[string]string           // maps nested functions' names to their mangled names
+	protos          map[string]*fnPrototypeNode // maps function names to their prototypes, for type checking calls
+	enumConsts      map[string]float64          // maps enum members to their values
+	opaqueTypes     map[string]llvm.Type        // maps the names of opaque types to their structs; see llvmType
+	tmpCounts       map[string]int              // counts the temporaries of each name in the current function; see tmp
+	versions        map[string]llvm.Value       // the definition each redefined function forwards to; see forward
+	loops           []loopTargets               // the loops enclosing the code being generated, innermost last
+
+	// if non-nil, each function's IR is appended to these before and
+	// after the function passes run, for -emit-llvm-both.
+	unoptIR, optIR *bytes.Buffer
+
+	// if non-nil, counts each function's code before the function
+	// passes run, for -stats.
+	stats *Stats
+
+	// the variables captured by the nested function being generated,
+	// which functionNode.codegen makes its locals; see nestedFnNode.
+	closure *closure
+
+	boundsCheck bool // check array indexes at run time, for -bounds-check
+	trapDivZero bool // check divisors at run time, for -trap-divzero
+	redefine    bool // let definitions replace earlier ones, for the REPL
+	intWidth    int  // the number of bits in an int, for -int-width
+	stackGuard  int  // how deeply calls may nest, for -stack-guard; 0 for no limit
+	guarded     bool // the function being generated counts itself in the call depth; see guardStack
+}
+
+// closure describes the variables a nested function captures from the
+// function enclosing it. They're copied into an environment struct when
+// the nested function is defined, and a pointer to it is passed to the
+// nested function as a hidden last parameter.
+type closure struct {
+	env   string    // the name of the hidden parameter, envPrefix + the function's name
+	names []string  // the captured variables, in the order of env's fields
+	typ   llvm.Type // the environment struct
+}
+
+// envPrefix begins the names under which namedVals holds the environment
+// pointers of nested functions that capture variables. Identifiers
+// can't contain spaces, so they can't collide with variables.
+const envPrefix = "env "
 
-func init() {
+// loopTargets are the blocks that break and continue in a loop's body
+// branch to.
+type loopTargets struct {
+	breakBlk, continueBlk llvm.BasicBlock
+}
+
+// loopBody generates body, in which break and continue branch to the
+// given blocks.
+func (ctx *genContext) loopBody(body node, breakBlk, continueBlk llvm.BasicBlock) llvm.Value {
+	ctx.loops = append(ctx.loops, loopTargets{breakBlk, continueBlk})
+	defer func() { ctx.loops = ctx.loops[:len(ctx.loops)-1] }()
+	return body.codegen(ctx)
+}
+
+// builtins are the functions every program can call without declaring
+// them, with their numbers of parameters, all doubles. They're Go
+// functions, defined in lib.go.
+var builtins = map[string]int{"print": 1, "println": 1, "getchard": 0}
+
+// nativeInitErr is the result of initializing the native target, which
+// is done once for every genContext.
+var nativeInitErr = llvm.InitializeNativeTarget()
+
+// newGenContext creates a genContext with its own LLVM context, module
+// and JIT. It has no optimization passes until optimize is called.
+func newGenContext() (*genContext, error) {
 	if nativeInitErr != nil {
-		fmt.Fprintln(os.Stderr, nativeInitErr)
-		os.Exit(-1)
+		return nil, nativeInitErr
+	}
+	context := llvm.NewContext()
+	module := context.NewModule("root")
+	execEngine, err := llvm.NewJITCompiler(module, 0)
+	if err != nil {
+		context.Dispose()
+		return nil, err
+	}
+	ctx := &genContext{
+		context:     context,
+		module:      module,
+		funcPassMgr: llvm.NewFunctionPassManagerForModule(module),
+		modPassMgr:  llvm.NewPassManager(),
+		execEngine:  execEngine,
+		builder:     context.NewBuilder(),
+		namedVals:   map[string]llvm.Value{},
+		globalVals:  map[string]llvm.Value{},
+		localFuncs:  map[string]string{},
+		protos:      map[string]*fnPrototypeNode{},
+		enumConsts:  map[string]float64{},
+		opaqueTypes: map[string]llvm.Type{},
+		tmpCounts:   map[string]int{},
+		versions:    map[string]llvm.Value{},
+		intWidth:    64,
+	}
+	for name, n := range builtins {
+		params := make([]llvm.Type, n)
+		for i := range params {
+			params[i] = context.DoubleType()
+		}
+		ctx.namedFunction(name, context.DoubleType(), params...)
+	}
+	return ctx, nil
+}
+
+// optimize adds the passes for the optimization level, from 0 to 3, to
+// those run as each function is generated. Level 0 adds none; level 3
+// also unrolls loops and inlines calls, which needs module passes; see
+// optimizeModule.
+func (ctx *genContext) optimize(level int) {
+	if level <= 0 {
+		return
+	}
+	ctx.funcPassMgr.Add(ctx.execEngine.TargetData())
+	ctx.funcPassMgr.AddPromoteMemoryToRegisterPass()
+	ctx.funcPassMgr.AddInstructionCombiningPass()
+	if level >= 2 {
+		ctx.funcPassMgr.AddReassociatePass()
+		ctx.funcPassMgr.AddGVNPass()
+		ctx.funcPassMgr.AddTailCallEliminationPass()
+	}
+	if level >= 3 {
+		ctx.funcPassMgr.AddLoopRotatePass()
+		ctx.funcPassMgr.AddLICMPass()
+		ctx.funcPassMgr.AddLoopUnrollPass()
+		ctx.modPassMgr.AddFunctionInliningPass()
+		ctx.runModulePasses = true
+	}
+	ctx.funcPassMgr.AddCFGSimplificationPass()
+	ctx.funcPassMgr.InitializeFunc()
+}
+
+// optimizeModule runs the module passes, if there are any, provided
+// functions have been defined since they last ran. They work on the
+// whole module, so rather than after each function, they're run before
+// an expression is and before the module is written out: once, for a
+// whole program.
+func (ctx *genContext) optimizeModule() {
+	if ctx.runModulePasses && ctx.moduleChanged {
+		ctx.modPassMgr.Run(ctx.module)
+		ctx.moduleChanged = false
+	}
+}
+
+// llvmType returns the LLVM type used to represent values of the named
+// type. The empty name is the default double, "int" is an integer as
+// wide as the Engine's IntWidth option, 64 bits unless set, "bool" is
+// an i1 and "string" is an i8* to NUL-terminated bytes. "fn" is a
+// function value, whatever its arity: a pointer to a function of
+// doubles returning a double, which is cast to the arity of each call
+// through it. Any other name must be an opaque type
+// declared with 'extern type', which is a pointer to a struct of that
+// name whose body is never given, so that handles of one type can't be
+// passed as another, or as strings.
+func (ctx *genContext) llvmType(name string) llvm.Type {
+	switch name {
+	case "":
+		return ctx.context.DoubleType()
+	case "int":
+		return ctx.intType()
+	case "bool":
+		return ctx.context.Int1Type()
+	case "string":
+		return llvm.PointerType(ctx.context.Int8Type(), 0)
+	case "fn":
+		return llvm.PointerType(llvm.FunctionType(ctx.context.DoubleType(), nil, false), 0)
+	}
+	t, ok := ctx.opaqueTypes[name]
+	if !ok {
+		t = ctx.context.StructCreateNamed(name)
+		ctx.opaqueTypes[name] = t
+	}
+	return llvm.PointerType(t, 0)
+}
+
+// intType returns the LLVM type of integers, which are 64 bits wide
+// unless the Engine's IntWidth option says otherwise.
+func (ctx *genContext) intType() llvm.Type {
+	return ctx.context.IntType(ctx.intWidth)
+}
+
+// typeName returns a user-facing name for the LLVM type t.
+func (ctx *genContext) typeName(t llvm.Type) string {
+	switch t {
+	case ctx.context.DoubleType():
+		return "double"
+	case ctx.intType():
+		return "int"
+	case ctx.context.Int1Type():
+		return "bool"
+	case ctx.llvmType("string"):
+		return "string"
+	case ctx.llvmType("fn"):
+		return "fn"
+	}
+	switch t.TypeKind() {
+	case llvm.ArrayTypeKind:
+		return "array"
+	case llvm.PointerTypeKind:
+		if name := t.ElementType().StructName(); name != "" {
+			return name // an opaque type
+		}
+	}
+	return "pointer"
+}
+
+// convert returns v as a value of type t. Integers are implicitly
+// converted to doubles, and booleans to doubles or integers (as 0 or
+// 1); any other conversion fails, returning nil.
+func (ctx *genContext) convert(v llvm.Value, t llvm.Type) llvm.Value {
+	switch {
+	case v.Type() == t:
+		return v
+	case v.Type() == ctx.intType() && t == ctx.context.DoubleType():
+		return ctx.builder.CreateSIToFP(v, t, ctx.tmp("itofp"))
+	case v.Type() == ctx.context.Int1Type() && t == ctx.context.DoubleType():
+		return ctx.builder.CreateUIToFP(v, t, ctx.tmp("bool"))
+	case v.Type() == ctx.context.Int1Type() && t == ctx.intType():
+		return ctx.builder.CreateZExt(v, t, ctx.tmp("bool"))
+	}
+	return llvm.Value{}
+}
+
+// promoteBools converts the boolean operands of arithmetic and
+// comparisons to numbers: to the type of the other operand if that's
+// an integer, or else to doubles.
+func (ctx *genContext) promoteBools(l, r llvm.Value) (llvm.Value, llvm.Value) {
+	t := ctx.context.DoubleType()
+	if l.Type() == ctx.intType() || r.Type() == ctx.intType() {
+		t = ctx.intType()
+	}
+	if l.Type() == ctx.context.Int1Type() {
+		l = ctx.convert(l, t)
 	}
-	if jitInitErr != nil {
-		fmt.Fprintln(os.Stderr, jitInitErr)
-		os.Exit(-1)
+	if r.Type() == ctx.context.Int1Type() {
+		r = ctx.convert(r, t)
 	}
+	return l, r
 }
 
-func Optimize() {
-	rootFuncPassMgr.Add(execEngine.TargetData())
-	rootFuncPassMgr.AddPromoteMemoryToRegisterPass()
-	rootFuncPassMgr.AddInstructionCombiningPass()
-	rootFuncPassMgr.AddReassociatePass()
-	rootFuncPassMgr.AddGVNPass()
-	rootFuncPassMgr.AddCFGSimplificationPass()
-	rootFuncPassMgr.InitializeFunc()
+// condition returns an i1 that is true if v, a boolean, double or
+// integer, is true or non-zero.
+func (ctx *genContext) condition(v llvm.Value, name string) llvm.Value {
+	switch v.Type() {
+	case ctx.context.Int1Type():
+		return v
+	case ctx.intType():
+		return ctx.builder.CreateICmp(llvm.IntNE, v, llvm.ConstInt(ctx.intType(), 0, false), name)
+	}
+	return ctx.builder.CreateFCmp(llvm.FloatONE, v, llvm.ConstFloat(ctx.context.DoubleType(), 0), name)
 }
 
-func createEntryBlockAlloca(f llvm.Value, name string) llvm.Value {
-	var tmpB = llvm.NewBuilder()
+// tmp returns a name for a temporary value: base followed by the number
+// of earlier temporaries named base in the current function, e.g. add.0
+// or add.1. The counts start over in each function, so its IR doesn't
+// depend on what was generated before it.
+func (ctx *genContext) tmp(base string) string {
+	i := ctx.tmpCounts[base]
+	ctx.tmpCounts[base]++
+	return fmt.Sprintf("%s.%d", base, i)
+}
+
+func (ctx *genContext) createEntryBlockAlloca(f llvm.Value, t llvm.Type, name string) llvm.Value {
+	var tmpB = ctx.context.NewBuilder()
 	tmpB.SetInsertPoint(f.EntryBasicBlock(), f.EntryBasicBlock().FirstInstruction())
-	return tmpB.CreateAlloca(llvm.DoubleType(), name)
+	return tmpB.CreateAlloca(t, name)
 }
 
-func (n *fnPrototypeNode) createArgAlloca(f llvm.Value) {
+func (n *fnPrototypeNode) createArgAlloca(ctx *genContext, f llvm.Value) {
 	args := f.Params()
 	for i := range args {
-		alloca := createEntryBlockAlloca(f, n.args[i])
-		builder.CreateStore(args[i], alloca)
-		namedVals[n.args[i]] = alloca
+		alloca := ctx.createEntryBlockAlloca(f, args[i].Type(), n.args[i])
+		ctx.builder.CreateStore(args[i], alloca)
+		ctx.namedVals[n.args[i]] = alloca
 	}
 }
 
-func (n *numberNode) codegen() llvm.Value {
-	return llvm.ConstFloat(llvm.DoubleType(), n.val)
+func (n *numberNode) codegen(ctx *genContext) llvm.Value {
+	return llvm.ConstFloat(ctx.context.DoubleType(), n.val)
+}
+
+func (n *integerNode) codegen(ctx *genContext) llvm.Value {
+	if wrap(n.val, ctx.intWidth) != n.val {
+		return ctx.errorAt(n.Pos, fmt.Sprintf("integer literal %d doesn't fit in a %d-bit int", n.val, ctx.intWidth))
+	}
+	return llvm.ConstInt(ctx.intType(), uint64(n.val), true)
 }
 
-func (n *variableNode) codegen() llvm.Value {
-	v := namedVals[n.name]
+func (n *boolNode) codegen(ctx *genContext) llvm.Value {
+	if n.val {
+		return llvm.ConstInt(ctx.context.Int1Type(), 1, false)
+	}
+	return llvm.ConstInt(ctx.context.Int1Type(), 0, false)
+}
+
+func (n *stringNode) codegen(ctx *genContext) llvm.Value {
+	return ctx.builder.CreateGlobalStringPtr(n.val, "str")
+}
+
+func (n *rationalNode) codegen(ctx *genContext) llvm.Value {
+	ctx.warning(fmt.Sprintf("rational literal %d/%dr lowered to double", n.num, n.den))
+	return llvm.ConstFloat(ctx.context.DoubleType(), float64(n.num)/float64(n.den))
+}
+
+func (n *variableNode) codegen(ctx *genContext) llvm.Value {
+	v := ctx.lookup(n.name)
 	if v.IsNil() {
-		return ErrorV("unknown variable name")
+		// variables shadow enum members.
+		if c, ok := ctx.enumConsts[n.name]; ok {
+			return llvm.ConstFloat(ctx.context.DoubleType(), c)
+		}
+		// and functions, whose names are their values.
+		if f := ctx.functionValue(n); !f.IsNil() || ctx.isFunction(n.name) {
+			return f
+		}
+		return ctx.errorCode(errUnknownVariable, n.Pos, "unknown variable name: "+n.name)
+	}
+	if v.Type().ElementType().TypeKind() == llvm.ArrayTypeKind {
+		return ctx.errorAt(n.Pos, "array "+n.name+" must be indexed")
+	}
+	return ctx.builder.CreateLoad(v, n.name)
+}
+
+// isFunction reports whether name is a function in scope.
+func (ctx *genContext) isFunction(name string) bool {
+	_, local := ctx.localFuncs[name]
+	return local || !ctx.module.NamedFunction(name).IsNil()
+}
+
+// functionValue returns the function that n names as a value of type
+// fn, or nil if there's no such function or it can't be a value. Only
+// functions of doubles returning a double can be, and nested functions
+// only if they capture nothing, as the value has no room for an
+// environment.
+func (ctx *genContext) functionValue(n *variableNode) llvm.Value {
+	name := n.name
+	if mangled, ok := ctx.localFuncs[name]; ok {
+		if !ctx.namedVals[envPrefix+name].IsNil() {
+			return ctx.errorAt(n.Pos, "nested function "+name+" captures variables, so it can't be used as a value")
+		}
+		name = mangled
+	}
+	f := ctx.module.NamedFunction(name)
+	if f.IsNil() {
+		return f
+	}
+	double := ctx.context.DoubleType()
+	t := f.Type().ElementType()
+	ok := t.ReturnType() == double && !t.IsFunctionVarArg()
+	for _, p := range t.ParamTypes() {
+		ok = ok && p == double
+	}
+	if !ok {
+		return ctx.errorAt(n.Pos, "function "+n.name+" can't be used as a value: fn values take and return doubles")
+	}
+	return ctx.builder.CreatePointerCast(f, ctx.llvmType("fn"), ctx.tmp(n.name))
+}
+
+func (n *indexNode) codegen(ctx *genContext) llvm.Value {
+	p := ctx.elementPtr(n)
+	if p.IsNil() {
+		return p
+	}
+	return ctx.builder.CreateLoad(p, n.name)
+}
+
+// elementPtr returns a pointer to the array element that n indexes.
+// If bounds checking is on, an index outside the array aborts the
+// program.
+func (ctx *genContext) elementPtr(n *indexNode) llvm.Value {
+	array := ctx.lookup(n.name)
+	if array.IsNil() {
+		return ctx.errorCode(errUnknownVariable, n.Pos, "unknown variable name: "+n.name)
+	}
+	if array.Type().ElementType().TypeKind() != llvm.ArrayTypeKind {
+		return ctx.errorAt(n.Pos, n.name+" is not an array")
+	}
+
+	index := n.index.codegen(ctx)
+	if index.IsNil() {
+		return ctx.errorV("code generation failed for index")
+	}
+	if index.Type() == ctx.context.DoubleType() {
+		index = ctx.builder.CreateFPToSI(index, ctx.intType(), ctx.tmp("index"))
+	} else if index = ctx.convert(index, ctx.intType()); index.IsNil() {
+		return ctx.errorAt(n.Pos, "index of "+n.name+" must be a number")
+	}
+
+	if ctx.boundsCheck && !ctx.checkBounds(index, array.Type().ElementType().ArrayLength(), n.name) {
+		return llvm.Value{}
+	}
+
+	zero := llvm.ConstInt(ctx.intType(), 0, false)
+	return ctx.builder.CreateGEP(array, []llvm.Value{zero, index}, ctx.tmp("elem"))
+}
+
+// lookup returns the storage of the named variable: the local's alloca
+// if there is one, as locals shadow globals, or else the global.
+func (ctx *genContext) lookup(name string) llvm.Value {
+	if v := ctx.namedVals[name]; !v.IsNil() {
+		return v
 	}
-	return builder.CreateLoad(v, n.name)
+	return ctx.globalVals[name]
 }
 
-func (n *ifNode) codegen() llvm.Value {
-	ifv := n.ifN.codegen()
+func (n *ifNode) codegen(ctx *genContext) llvm.Value {
+	ifv := n.ifN.codegen(ctx)
 	if ifv.IsNil() {
-		return ErrorV("code generation failed for if expression")
+		return ctx.errorV("code generation failed for if expression")
 	}
-	ifv = builder.CreateFCmp(llvm.FloatONE, ifv, llvm.ConstFloat(llvm.DoubleType(), 0), "ifcond")
+	ifv = ctx.condition(ifv, ctx.tmp("ifcond"))
 
-	parentFunc := builder.GetInsertBlock().Parent()
-	thenBlk := llvm.AddBasicBlock(parentFunc, "then")
-	elseBlk := llvm.AddBasicBlock(parentFunc, "else")
-	mergeBlk := llvm.AddBasicBlock(parentFunc, "merge")
-	builder.CreateCondBr(ifv, thenBlk, elseBlk)
+	parentFunc := ctx.builder.GetInsertBlock().Parent()
+	thenBlk := ctx.context.AddBasicBlock(parentFunc, "then")
+	elseBlk := ctx.context.AddBasicBlock(parentFunc, "else")
+	mergeBlk := ctx.context.AddBasicBlock(parentFunc, "merge")
+	ctx.builder.CreateCondBr(ifv, thenBlk, elseBlk)
 
 	// generate 'then' block
-	builder.SetInsertPointAtEnd(thenBlk)
-	thenv := n.thenN.codegen()
+	ctx.builder.SetInsertPointAtEnd(thenBlk)
+	thenv := n.thenN.codegen(ctx)
 	if thenv.IsNil() {
-		return ErrorV("code generation failed for then expression")
+		return ctx.errorV("code generation failed for then expression")
 	}
-	builder.CreateBr(mergeBlk)
+	ctx.builder.CreateBr(mergeBlk)
 	// Codegen of 'Then' can change the current block, update ThenBB for the PHI.
-	thenBlk = builder.GetInsertBlock()
+	thenBlk = ctx.builder.GetInsertBlock()
 
 	// generate 'else' block
 	// C++ unknown eq: TheFunction->getBasicBlockList().push_back(ElseBB);
-	builder.SetInsertPointAtEnd(elseBlk)
-	elsev := n.elseN.codegen()
+	ctx.builder.SetInsertPointAtEnd(elseBlk)
+	elsev := n.elseN.codegen(ctx)
 	if elsev.IsNil() {
-		return ErrorV("code generation failed for else expression")
+		return ctx.errorV("code generation failed for else expression")
 	}
-	builder.CreateBr(mergeBlk)
-	elseBlk = builder.GetInsertBlock()
+	// if one branch converts to the other's type, e.g. an integer to a
+	// double, it's converted.
+	if elsev.Type() != thenv.Type() {
+		if v := ctx.convert(elsev, thenv.Type()); !v.IsNil() {
+			elsev = v
+		}
+	}
+	ctx.builder.CreateBr(mergeBlk)
+	elseBlk = ctx.builder.GetInsertBlock()
 
-	builder.SetInsertPointAtEnd(mergeBlk)
-	PhiNode := builder.CreatePHI(llvm.DoubleType(), "iftmp")
+	if thenv.Type() != elsev.Type() {
+		ctx.builder.SetInsertPoint(thenBlk, thenBlk.LastInstruction())
+		if thenv = ctx.convert(thenv, elsev.Type()); thenv.IsNil() {
+			return ctx.errorV("then and else expressions have different types")
+		}
+	}
+
+	ctx.builder.SetInsertPointAtEnd(mergeBlk)
+	PhiNode := ctx.builder.CreatePHI(thenv.Type(), ctx.tmp("if"))
 	PhiNode.AddIncoming([]llvm.Value{thenv}, []llvm.BasicBlock{thenBlk})
 	PhiNode.AddIncoming([]llvm.Value{elsev}, []llvm.BasicBlock{elseBlk})
 	return PhiNode
 }
 
-func (n *forNode) codegen() llvm.Value {
-	startVal := n.start.codegen()
+func (n *forNode) codegen(ctx *genContext) llvm.Value {
+	startVal := n.start.codegen(ctx)
 	if startVal.IsNil() {
-		return ErrorV("code generation failed for start expression")
+		return ctx.errorV("code generation failed for start expression")
 	}
 
-	parentFunc := builder.GetInsertBlock().Parent()
-	alloca := createEntryBlockAlloca(parentFunc, n.counter)
-	builder.CreateStore(startVal, alloca)
-	loopBlk := llvm.AddBasicBlock(parentFunc, "loop")
+	parentFunc := ctx.builder.GetInsertBlock().Parent()
+	alloca := ctx.createEntryBlockAlloca(parentFunc, startVal.Type(), n.counter)
+	ctx.builder.CreateStore(startVal, alloca)
+	loopBlk := ctx.context.AddBasicBlock(parentFunc, "loop")
+	stepBlk := ctx.context.AddBasicBlock(parentFunc, "loopstep")
+	afterBlk := ctx.context.AddBasicBlock(parentFunc, "afterloop")
 
-	builder.CreateBr(loopBlk)
+	ctx.builder.CreateBr(loopBlk)
 
-	builder.SetInsertPointAtEnd(loopBlk)
+	ctx.builder.SetInsertPointAtEnd(loopBlk)
 
 	// save higher levels' variables if we have the same name
-	oldVal := namedVals[n.counter]
-	namedVals[n.counter] = alloca
+	oldVal := ctx.namedVals[n.counter]
+	ctx.namedVals[n.counter] = alloca
 
-	if n.body.codegen().IsNil() {
-		return ErrorV("code generation failed for body expression")
+	if ctx.loopBody(n.body, afterBlk, stepBlk).IsNil() {
+		return ctx.errorV("code generation failed for body expression")
 	}
+	// continue skips to the step.
+	ctx.builder.CreateBr(stepBlk)
+	ctx.builder.SetInsertPointAtEnd(stepBlk)
 
 	var stepVal llvm.Value
 	if n.step != nil {
-		stepVal = n.step.codegen()
+		stepVal = n.step.codegen(ctx)
 		if stepVal.IsNil() {
-			return llvm.ConstNull(llvm.DoubleType())
+			return llvm.ConstNull(ctx.context.DoubleType())
+		}
+		if stepVal = ctx.convert(stepVal, startVal.Type()); stepVal.IsNil() {
+			return ctx.errorV("step doesn't match the type of the loop counter")
 		}
+	} else if startVal.Type() == ctx.intType() {
+		stepVal = llvm.ConstInt(ctx.intType(), 1, false)
 	} else {
-		stepVal = llvm.ConstFloat(llvm.DoubleType(), 1)
+		stepVal = llvm.ConstFloat(ctx.context.DoubleType(), 1)
 	}
 
-	// evaluate end condition before increment
-	endVal := n.test.codegen()
+	// evaluate end condition before increment. It alone decides whether
+	// the loop continues, whatever the sign of the step.
+	endVal := n.test.codegen(ctx)
 	if endVal.IsNil() {
 		return endVal
 	}
 
-	curVar := builder.CreateLoad(alloca, n.counter)
-	nextVar := builder.CreateFAdd(curVar, stepVal, "nextvar")
-	builder.CreateStore(nextVar, alloca)
+	curVar := ctx.builder.CreateLoad(alloca, n.counter)
+	var nextVar llvm.Value
+	if startVal.Type() == ctx.intType() {
+		nextVar = ctx.builder.CreateAdd(curVar, stepVal, ctx.tmp("nextvar"))
+	} else {
+		nextVar = ctx.builder.CreateFAdd(curVar, stepVal, ctx.tmp("nextvar"))
+	}
+	ctx.builder.CreateStore(nextVar, alloca)
 
-	endVal = builder.CreateFCmp(llvm.FloatONE, endVal, llvm.ConstFloat(llvm.DoubleType(), 0), "loopcond")
-	afterBlk := llvm.AddBasicBlock(parentFunc, "afterloop")
+	endVal = ctx.condition(endVal, ctx.tmp("loopcond"))
+	ctx.builder.CreateCondBr(endVal, loopBlk, afterBlk)
 
-	builder.CreateCondBr(endVal, loopBlk, afterBlk)
+	ctx.builder.SetInsertPointAtEnd(afterBlk)
 
-	builder.SetInsertPointAtEnd(afterBlk)
+	// the result is evaluated while the counter is still in scope.
+	resultVal := llvm.ConstFloat(ctx.context.DoubleType(), 0)
+	if n.result != nil {
+		resultVal = n.result.codegen(ctx)
+		if resultVal.IsNil() {
+			return ctx.errorV("code generation failed for yielding expression")
+		}
+	}
 
 	if !oldVal.IsNil() {
-		namedVals[n.counter] = oldVal
+		ctx.namedVals[n.counter] = oldVal
 	} else {
-		delete(namedVals, n.counter)
+		delete(ctx.namedVals, n.counter)
+	}
+
+	return resultVal
+}
+
+func (n *whileNode) codegen(ctx *genContext) llvm.Value {
+	parentFunc := ctx.builder.GetInsertBlock().Parent()
+	condBlk := ctx.context.AddBasicBlock(parentFunc, "loopcond")
+	loopBlk := ctx.context.AddBasicBlock(parentFunc, "loop")
+	afterBlk := ctx.context.AddBasicBlock(parentFunc, "afterloop")
+
+	// the condition is tested before every iteration, including the first.
+	ctx.builder.CreateBr(condBlk)
+	ctx.builder.SetInsertPointAtEnd(condBlk)
+	condVal := n.cond.codegen(ctx)
+	if condVal.IsNil() {
+		return ctx.errorV("code generation failed for while condition")
+	}
+	ctx.builder.CreateCondBr(ctx.condition(condVal, ctx.tmp("whilecond")), loopBlk, afterBlk)
+
+	ctx.builder.SetInsertPointAtEnd(loopBlk)
+	if ctx.loopBody(n.body, afterBlk, condBlk).IsNil() {
+		return ctx.errorV("code generation failed for body expression")
 	}
+	ctx.builder.CreateBr(condBlk)
 
-	return llvm.ConstFloat(llvm.DoubleType(), 0)
+	ctx.builder.SetInsertPointAtEnd(afterBlk)
+	return llvm.ConstFloat(ctx.context.DoubleType(), 0)
 }
 
-func (n *unaryNode) codegen() llvm.Value {
-	operandValue := n.operand.codegen()
+func (n *doWhileNode) codegen(ctx *genContext) llvm.Value {
+	parentFunc := ctx.builder.GetInsertBlock().Parent()
+	loopBlk := ctx.context.AddBasicBlock(parentFunc, "loop")
+	condBlk := ctx.context.AddBasicBlock(parentFunc, "loopcond")
+	afterBlk := ctx.context.AddBasicBlock(parentFunc, "afterloop")
+
+	// the body runs before the condition is first tested.
+	ctx.builder.CreateBr(loopBlk)
+	ctx.builder.SetInsertPointAtEnd(loopBlk)
+	if ctx.loopBody(n.body, afterBlk, condBlk).IsNil() {
+		return ctx.errorV("code generation failed for body expression")
+	}
+	ctx.builder.CreateBr(condBlk)
+
+	ctx.builder.SetInsertPointAtEnd(condBlk)
+	condVal := n.cond.codegen(ctx)
+	if condVal.IsNil() {
+		return ctx.errorV("code generation failed for while condition")
+	}
+	ctx.builder.CreateCondBr(ctx.condition(condVal, ctx.tmp("whilecond")), loopBlk, afterBlk)
+
+	ctx.builder.SetInsertPointAtEnd(afterBlk)
+	return llvm.ConstFloat(ctx.context.DoubleType(), 0)
+}
+
+func (n *unaryNode) codegen(ctx *genContext) llvm.Value {
+	operandValue := n.operand.codegen(ctx)
 	if operandValue.IsNil() {
-		return ErrorV("nil operand")
+		return ctx.errorV("nil operand")
 	}
 
-	f := rootModule.NamedFunction("unary" + string(n.name))
+	// negation is built in.
+	if n.name == "-" {
+		if operandValue.Type() == ctx.context.Int1Type() {
+			operandValue = ctx.convert(operandValue, ctx.context.DoubleType())
+		}
+		switch operandValue.Type() {
+		case ctx.intType():
+			return ctx.builder.CreateNeg(operandValue, ctx.tmp("neg"))
+		case ctx.context.DoubleType():
+			return ctx.builder.CreateFNeg(operandValue, ctx.tmp("neg"))
+		}
+		return ctx.errorV("operand of unary - must be a number")
+	}
+
+	f := ctx.module.NamedFunction("unary" + string(n.name))
 	if f.IsNil() {
-		return ErrorV("unknown unary operator")
+		return ctx.errorV("unknown unary operator")
+	}
+	if operandValue = ctx.convert(operandValue, f.Param(0).Type()); operandValue.IsNil() {
+		return ctx.errorV("operand of unary" + n.name + " has the wrong type")
+	}
+	return ctx.builder.CreateCall(f, []llvm.Value{operandValue}, ctx.tmp("unop"))
+}
+
+func (n *incDecNode) codegen(ctx *genContext) llvm.Value {
+	p := ctx.lookup(n.name)
+	if p.IsNil() {
+		return ctx.errorCode(errUnknownVariable, n.Pos, "unknown variable name: "+n.name)
 	}
-	return builder.CreateCall(f, []llvm.Value{operandValue}, "unop")
+	old := ctx.builder.CreateLoad(p, n.name)
+	var updated llvm.Value
+	switch t := old.Type(); {
+	case t == ctx.intType() && n.op == "++":
+		updated = ctx.builder.CreateAdd(old, llvm.ConstInt(t, 1, false), ctx.tmp("inc"))
+	case t == ctx.intType():
+		updated = ctx.builder.CreateSub(old, llvm.ConstInt(t, 1, false), ctx.tmp("dec"))
+	case t == ctx.context.DoubleType() && n.op == "++":
+		updated = ctx.builder.CreateFAdd(old, llvm.ConstFloat(t, 1), ctx.tmp("inc"))
+	case t == ctx.context.DoubleType():
+		updated = ctx.builder.CreateFSub(old, llvm.ConstFloat(t, 1), ctx.tmp("dec"))
+	default:
+		return ctx.errorV("operand of " + n.op + " must be a number")
+	}
+	ctx.builder.CreateStore(updated, p)
+
+	if n.prefix {
+		return updated
+	}
+	return old
 }
 
-func (n *variableExprNode) codegen() llvm.Value {
+func (n *variableExprNode) codegen(ctx *genContext) llvm.Value {
 	var oldvars = []llvm.Value{}
+	var last llvm.Value
 
-	f := builder.GetInsertBlock().Parent()
+	f := ctx.builder.GetInsertBlock().Parent()
 	for i := range n.vars {
 		name := n.vars[i].name
 		node := n.vars[i].node
 
 		var val llvm.Value
 		if node != nil {
-			val = node.codegen()
+			val = node.codegen(ctx)
 			if val.IsNil() {
 				return val // nil
 			}
+		} else if size := n.vars[i].size; size > 0 { // arrays start zeroed
+			val = llvm.ConstNull(llvm.ArrayType(ctx.context.DoubleType(), size))
 		} else { // if no initialized value set to 0
-			val = llvm.ConstFloat(llvm.DoubleType(), 0)
+			val = llvm.ConstFloat(ctx.context.DoubleType(), 0)
 		}
 
-		alloca := createEntryBlockAlloca(f, name)
-		builder.CreateStore(val, alloca)
+		alloca := ctx.createEntryBlockAlloca(f, val.Type(), name)
+		ctx.builder.CreateStore(val, alloca)
+
+		oldvars = append(oldvars, ctx.namedVals[name])
+		ctx.namedVals[name] = alloca
+		last = val
+		if n.vars[i].size > 0 {
+			last = llvm.ConstFloat(ctx.context.DoubleType(), 0)
+		}
+	}
 
-		oldvars = append(oldvars, namedVals[name])
-		namedVals[name] = alloca
+	// a declaration in a block: the block pops the vars at its end.
+	if n.body == nil {
+		return last
 	}
 
 	// evaluate body now that vars are in scope
-	bodyVal := n.body.codegen()
+	bodyVal := n.body.codegen(ctx)
 	if bodyVal.IsNil() {
-		return ErrorV("body returns nil") // nil
+		return ctx.errorV("body returns nil") // nil
 	}
 
 	// pop old values
 	for i := range n.vars {
-		namedVals[n.vars[i].name] = oldvars[i]
+		ctx.namedVals[n.vars[i].name] = oldvars[i]
 	}
 
 	return bodyVal
 }
 
-func (n *fnCallNode) codegen() llvm.Value {
-	callee := rootModule.NamedFunction(n.callee)
+func (n *blockNode) codegen(ctx *genContext) llvm.Value {
+	// variables declared in the block go out of scope at its end.
+	outer := ctx.namedVals
+	ctx.namedVals = make(map[string]llvm.Value, len(outer))
+	for name, v := range outer {
+		ctx.namedVals[name] = v
+	}
+	defer func() { ctx.namedVals = outer }()
+
+	var v llvm.Value
+	for _, e := range n.exprs {
+		if v = e.codegen(ctx); v.IsNil() {
+			return ctx.errorV("code generation failed for block expression")
+		}
+	}
+	return v
+}
+
+func (n *returnNode) codegen(ctx *genContext) llvm.Value {
+	f := ctx.builder.GetInsertBlock().Parent()
+	if f.Name() == "" {
+		return ctx.errorV("return outside of a function definition")
+	}
+	v := n.value.codegen(ctx)
+	if v.IsNil() {
+		return ctx.errorV("code generation failed for return value")
+	}
+	if v = ctx.convert(v, f.Type().ElementType().ReturnType()); v.IsNil() {
+		return ctx.errorV("return value doesn't match the declared return type")
+	}
+	ctx.ret(v)
+
+	// code following the return is unreachable, but still needs a block
+	// to go in; the function passes remove it.
+	ctx.builder.SetInsertPointAtEnd(ctx.context.AddBasicBlock(f, "afterreturn"))
+	return llvm.Undef(v.Type())
+}
+
+func (n *breakNode) codegen(ctx *genContext) llvm.Value {
+	if len(ctx.loops) == 0 {
+		return ctx.errorAt(n.Pos, "break outside a loop")
+	}
+	return ctx.jump(ctx.loops[len(ctx.loops)-1].breakBlk)
+}
+
+func (n *continueNode) codegen(ctx *genContext) llvm.Value {
+	if len(ctx.loops) == 0 {
+		return ctx.errorAt(n.Pos, "continue outside a loop")
+	}
+	return ctx.jump(ctx.loops[len(ctx.loops)-1].continueBlk)
+}
+
+// checkBounds branches to a block that reports the error and aborts if
+// index isn't in [0, length). Compared unsigned, negative indexes are
+// too large. It reports whether it could; see trap.
+func (ctx *genContext) checkBounds(index llvm.Value, length int, name string) bool {
+	limit := llvm.ConstInt(ctx.intType(), uint64(length), false)
+	ok := ctx.builder.CreateICmp(llvm.IntULT, index, limit, ctx.tmp("bounds"))
+	return ctx.trap(ok, "outofbounds", "index out of range for array "+name)
+}
+
+// checkDivisor branches to a block that reports the error and aborts if
+// the divisor d, an int or double, is zero. It reports whether it
+// could; see trap.
+func (ctx *genContext) checkDivisor(d llvm.Value, pos Pos) bool {
+	var ok llvm.Value
+	if d.Type() == ctx.intType() {
+		ok = ctx.builder.CreateICmp(llvm.IntNE, d, llvm.ConstInt(d.Type(), 0, false), ctx.tmp("divisor"))
+	} else {
+		ok = ctx.builder.CreateFCmp(llvm.FloatUNE, d, llvm.ConstFloat(d.Type(), 0), ctx.tmp("divisor"))
+	}
+	return ctx.trap(ok, "divzero", fmt.Sprintf("division by zero at %v", pos))
+}
+
+// trap continues in a new block if ok is true, and otherwise branches
+// to the block named name, which prints msg with the C library's puts
+// and aborts. If the program has taken either name for a function of
+// its own, it reports an error and returns false instead.
+func (ctx *genContext) trap(ok llvm.Value, name, msg string) bool {
+	puts := ctx.cFunction("puts", ctx.context.Int32Type(), llvm.PointerType(ctx.context.Int8Type(), 0))
+	abort := ctx.cFunction("abort", ctx.context.VoidType())
+	if puts.IsNil() || abort.IsNil() {
+		ctx.errorV("run-time checks need the C library's puts and abort, but the program defines its own")
+		return false
+	}
+
+	f := ctx.builder.GetInsertBlock().Parent()
+	trapBlk := ctx.context.AddBasicBlock(f, name)
+	okBlk := ctx.context.AddBasicBlock(f, "continue")
+	ctx.builder.CreateCondBr(ok, okBlk, trapBlk)
+
+	ctx.builder.SetInsertPointAtEnd(trapBlk)
+	str := ctx.builder.CreateGlobalStringPtr(msg, "str")
+	ctx.builder.CreateCall(puts, []llvm.Value{str}, "")
+	ctx.builder.CreateCall(abort, nil, "")
+	ctx.builder.CreateUnreachable()
+
+	ctx.builder.SetInsertPointAtEnd(okBlk)
+	return true
+}
+
+// cFunction is namedFunction for a C library function, but returns nil
+// if the program has defined a function of the same name, or declared
+// one with another signature, as calling it would then be wrong.
+func (ctx *genContext) cFunction(name string, ret llvm.Type, params ...llvm.Type) llvm.Value {
+	f := ctx.namedFunction(name, ret, params...)
+	if f.BasicBlocksCount() != 0 || f.Type().ElementType() != llvm.FunctionType(ret, params, false) {
+		return llvm.Value{}
+	}
+	return f
+}
+
+// namedFunction returns the module's function name, declaring it with
+// the given signature if it isn't yet, as for C library functions and
+// LLVM intrinsics.
+func (ctx *genContext) namedFunction(name string, ret llvm.Type, params ...llvm.Type) llvm.Value {
+	if f := ctx.module.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	return llvm.AddFunction(ctx.module, name, llvm.FunctionType(ret, params, false))
+}
+
+// jump branches to target, for break and continue, whose value is 0.
+func (ctx *genContext) jump(target llvm.BasicBlock) llvm.Value {
+	ctx.builder.CreateBr(target)
+
+	// as after a return, the code that follows is unreachable.
+	f := ctx.builder.GetInsertBlock().Parent()
+	ctx.builder.SetInsertPointAtEnd(ctx.context.AddBasicBlock(f, "afterjump"))
+	return llvm.ConstFloat(ctx.context.DoubleType(), 0)
+}
+
+func (n *nestedFnNode) codegen(ctx *genContext) llvm.Value {
+	fn := n.fn.(*functionNode)
+	proto := fn.proto.(*fnPrototypeNode)
+	block := ctx.builder.GetInsertBlock()
+
+	// mangle the name so that it can't collide with top-level functions
+	// or with nested functions of the same name elsewhere.
+	mangled := block.Parent().Name() + "." + proto.name
+	for i := 1; !ctx.module.NamedFunction(mangled).IsNil(); i++ {
+		mangled = fmt.Sprintf("%s.%s.%d", block.Parent().Name(), proto.name, i)
+	}
+
+	// register the name first so the nested function may recurse.
+	oldName, shadowed := ctx.localFuncs[proto.name]
+	ctx.localFuncs[proto.name] = mangled
+	defer func() {
+		if shadowed {
+			ctx.localFuncs[proto.name] = oldName
+		} else {
+			delete(ctx.localFuncs, proto.name)
+		}
+	}()
+
+	// the variables of the enclosing function that the nested one uses
+	// are captured by value, in an environment passed as a hidden last
+	// parameter.
+	envName := envPrefix + proto.name
+	args, argTypes := proto.args, proto.argTypes
+	var env *closure
+	if names := ctx.captures(fn, envName); len(names) > 0 {
+		fields := []llvm.Type{}
+		for _, name := range names {
+			fields = append(fields, ctx.namedVals[name].Type().ElementType())
+		}
+		env = &closure{envName, names, ctx.context.StructType(fields, false)}
+		args = append(append([]string{}, args...), envName)
+		argTypes = append(append([]string{}, argTypes...), "closure") // an i8*
+	}
+
+	// generating the nested function clobbers the ctx.builder's position
+	// and the enclosing function's variables, temporaries' counts and
+	// loops, so we restore them after.
+	oldVals, oldCounts, oldLoops := ctx.namedVals, ctx.tmpCounts, ctx.loops
+	nested := &functionNode{nodeFunction, fn.Pos, &fnPrototypeNode{
+		nodeFnPrototype, proto.Pos, mangled, args, false, 0, argTypes, proto.retType}, fn.body, false, false}
+	ctx.closure = env
+	f := nested.codegen(ctx)
+	ctx.closure = nil
+	ctx.namedVals, ctx.tmpCounts, ctx.loops = oldVals, oldCounts, oldLoops
+	ctx.builder.SetInsertPointAtEnd(block)
+	if f.IsNil() {
+		return ctx.errorV("code generation failed for nested function " + proto.name)
+	}
+
+	// calls to the nested function pass the environment if it has one.
+	oldEnv := ctx.namedVals[envName]
+	if env != nil {
+		ctx.namedVals[envName] = ctx.makeEnv(env)
+	} else {
+		delete(ctx.namedVals, envName)
+	}
+	defer func() {
+		if !oldEnv.IsNil() {
+			ctx.namedVals[envName] = oldEnv
+		} else {
+			delete(ctx.namedVals, envName)
+		}
+	}()
+
+	return n.body.codegen(ctx)
+}
+
+func (n *lambdaNode) codegen(ctx *genContext) llvm.Value {
+	fn := n.fn.(*functionNode)
+	proto := fn.proto.(*fnPrototypeNode)
+	block := ctx.builder.GetInsertBlock()
+
+	name := block.Parent().Name() + ".lambda"
+	for i := 1; !ctx.module.NamedFunction(name).IsNil(); i++ {
+		name = fmt.Sprintf("%s.lambda.%d", block.Parent().Name(), i)
+	}
+
+	// as for nested functions, restore the enclosing function's state.
+	oldVals, oldCounts, oldLoops := ctx.namedVals, ctx.tmpCounts, ctx.loops
+	lambda := &functionNode{nodeFunction, fn.Pos, &fnPrototypeNode{
+		nodeFnPrototype, proto.Pos, name, proto.args, false, 0, proto.argTypes, ""}, fn.body, false, false}
+	f := lambda.codegen(ctx)
+	ctx.namedVals, ctx.tmpCounts, ctx.loops = oldVals, oldCounts, oldLoops
+	ctx.builder.SetInsertPointAtEnd(block)
+	if f.IsNil() {
+		return ctx.errorV("code generation failed for lambda")
+	}
+	return ctx.builder.CreatePointerCast(f, ctx.llvmType("fn"), ctx.tmp("lambda"))
+}
+
+// captures returns the variables of the current function that fn, a
+// function nested in it, uses, including the environments of the
+// nested functions that fn calls. self is the name of fn's own
+// environment, which it has as a parameter.
+func (ctx *genContext) captures(fn *functionNode, self string) []string {
+	params := map[string]bool{self: true}
+	for _, a := range fn.proto.(*fnPrototypeNode).args {
+		params[a] = true
+	}
+	var names []string
+	use := func(name string) {
+		if !params[name] && !ctx.namedVals[name].IsNil() {
+			params[name] = true
+			names = append(names, name)
+		}
+	}
+	Walk(fn.body, func(n node) bool {
+		switch n := n.(type) {
+		case *variableNode:
+			use(n.name)
+		case *indexNode:
+			use(n.name)
+		case *incDecNode:
+			use(n.name)
+		case *fnCallNode:
+			use(envPrefix + n.callee)
+		}
+		return true
+	})
+	return names
+}
+
+// makeEnv copies the captured variables into a new environment for env
+// and returns a variable holding a pointer to it, as an i8*.
+func (ctx *genContext) makeEnv(env *closure) llvm.Value {
+	f := ctx.builder.GetInsertBlock().Parent()
+	s := ctx.createEntryBlockAlloca(f, env.typ, ctx.tmp("env"))
+	for i, name := range env.names {
+		v := ctx.builder.CreateLoad(ctx.namedVals[name], name)
+		ctx.builder.CreateStore(v, ctx.builder.CreateStructGEP(s, i, ctx.tmp("capture")))
+	}
+	i8p := ctx.llvmType("closure")
+	p := ctx.createEntryBlockAlloca(f, i8p, env.env)
+	ctx.builder.CreateStore(ctx.builder.CreatePointerCast(s, i8p, ctx.tmp("envptr")), p)
+	return p
+}
+
+// openEnv makes the captured variables of env, which is passed to the
+// function being generated, its local variables.
+func (ctx *genContext) openEnv(env *closure) {
+	p := ctx.builder.CreateLoad(ctx.namedVals[env.env], ctx.tmp("envptr"))
+	s := ctx.builder.CreatePointerCast(p, llvm.PointerType(env.typ, 0), ctx.tmp("env"))
+	for i, name := range env.names {
+		ctx.namedVals[name] = ctx.builder.CreateStructGEP(s, i, name)
+	}
+}
+
+func (n *fnCallNode) codegen(ctx *genContext) llvm.Value {
+	if _, ok := ctx.localFuncs[n.callee]; !ok {
+		// a variable holding a function value hides functions; one
+		// holding anything else is only an error if there's no function.
+		if v := ctx.lookup(n.callee); !v.IsNil() {
+			t := v.Type().ElementType()
+			if t == ctx.llvmType("fn") {
+				return n.codegenIndirect(ctx, ctx.builder.CreateLoad(v, n.callee))
+			}
+			if ctx.module.NamedFunction(n.callee).IsNil() {
+				return ctx.errorAt(n.Pos, fmt.Sprintf("%s is a variable of type %s, not a function, so it can't be called",
+					n.callee, ctx.typeName(t)))
+			}
+		}
+	}
+
+	name := n.callee
+	var env llvm.Value // the environment of a nested function, if it has one
+	if mangled, ok := ctx.localFuncs[name]; ok {
+		name = mangled
+		env = ctx.namedVals[envPrefix+n.callee]
+	}
+	callee := ctx.module.NamedFunction(name)
 	if callee.IsNil() {
-		return ErrorV("unknown function referenced")
+		return ctx.errorCode(errUnknownFunction, n.Pos, "unknown function referenced: "+n.callee)
 	}
 
-	if callee.ParamsCount() != len(n.args) {
-		return ErrorV("incorrect number of arguments passed")
+	hidden := 0
+	if !env.IsNil() {
+		hidden = 1
+	}
+	if callee.ParamsCount() != len(n.args)+hidden {
+		return ctx.errorCode(errArgCount, n.Pos, "incorrect number of arguments passed to "+n.callee)
 	}
 
 	args := []llvm.Value{}
-	for _, arg := range n.args {
-		args = append(args, arg.codegen())
-		if args[len(args)-1].IsNil() {
-			return ErrorV("an argument was nil")
+	params := callee.Params()
+	for i, arg := range n.args {
+		v := arg.codegen(ctx)
+		if v.IsNil() {
+			return ctx.errorV("an argument was nil")
+		}
+		c := ctx.convert(v, params[i].Type())
+		if c.IsNil() {
+			expected := ctx.typeName(params[i].Type())
+			if p, ok := ctx.protos[name]; ok && p.argTypes[i] != "" {
+				expected = p.argTypes[i]
+			}
+			return ctx.errorAt(n.Pos, fmt.Sprintf("argument %d (%s) of %s has type %s, expected %s",
+				i+1, params[i].Name(), n.callee, ctx.typeName(v.Type()), expected))
 		}
+		args = append(args, c)
+	}
+	if !env.IsNil() {
+		args = append(args, ctx.builder.CreateLoad(env, ctx.tmp("envptr")))
 	}
 
-	return builder.CreateCall(callee, args, "calltmp")
+	call := ctx.builder.CreateCall(callee, args, ctx.tmp("call"))
+	if n.tail {
+		call.SetTailCall(true)
+	}
+	return call
+}
+
+// codegenIndirect calls the function value f. Its arguments are passed
+// as doubles, and it returns a double. Nothing checks that f takes as
+// many arguments as it's given.
+func (n *fnCallNode) codegenIndirect(ctx *genContext, f llvm.Value) llvm.Value {
+	double := ctx.context.DoubleType()
+	params := make([]llvm.Type, len(n.args))
+	args := []llvm.Value{}
+	for i, arg := range n.args {
+		params[i] = double
+		v := arg.codegen(ctx)
+		if v.IsNil() {
+			return ctx.errorV("an argument was nil")
+		}
+		c := ctx.convert(v, double)
+		if c.IsNil() {
+			return ctx.errorAt(n.Pos, fmt.Sprintf("argument %d of %s has type %s, expected double",
+				i+1, n.callee, ctx.typeName(v.Type())))
+		}
+		args = append(args, c)
+	}
+	t := llvm.PointerType(llvm.FunctionType(double, params, false), 0)
+	callee := ctx.builder.CreatePointerCast(f, t, ctx.tmp("fnptr"))
+	return ctx.builder.CreateCall(callee, args, ctx.tmp("call"))
 }
 
-func (n *binaryNode) codegen() llvm.Value {
+func (n *binaryNode) codegen(ctx *genContext) llvm.Value {
 	// Special case '=' because we don't emit the LHS as an expression
 	if n.op == "=" {
-		l, ok := n.left.(*variableNode)
-		if !ok {
-			return ErrorV("destination of '=' must be a variable")
+		var name string
+		switch l := n.left.(type) {
+		case *variableNode:
+			name = l.name
+		case *indexNode:
+			name = l.name + "[]"
+		default:
+			return ctx.errorV("destination of '=' must be a variable or array element")
 		}
 
 		// get value
-		val := n.right.codegen()
+		val := n.right.codegen(ctx)
 		if val.IsNil() {
-			return ErrorV("cannot assign null value")
+			return ctx.errorV("cannot assign null value")
 		}
 
-		// lookup location of variable from name
-		p := namedVals[l.name]
+		// lookup location of variable from name, or of the element
+		var p llvm.Value
+		if l, ok := n.left.(*indexNode); ok {
+			if p = ctx.elementPtr(l); p.IsNil() {
+				return p
+			}
+		} else if p = ctx.lookup(name); p.IsNil() {
+			return ctx.errorCode(errUnknownVariable, n.left.Position(), "unknown variable name: "+name)
+		}
+		if val = ctx.convert(val, p.Type().ElementType()); val.IsNil() {
+			return ctx.errorV("cannot assign a value of a different type to " + name)
+		}
 
 		// store
-		builder.CreateStore(val, p)
+		ctx.builder.CreateStore(val, p)
 
 		return val
 	}
+	if n.op == "&&" || n.op == "||" {
+		return n.codegenLogical(ctx)
+	}
+	if folded := constFold(n, ctx.intWidth); folded != nil {
+		return folded.codegen(ctx)
+	}
+	if n.op == "/" && isZeroLiteral(n.right, ctx.intWidth) {
+		ctx.warning("division by constant zero")
+	}
 
-	l := n.left.codegen()
-	r := n.right.codegen()
+	l := n.left.codegen(ctx)
+	r := n.right.codegen(ctx)
 	if l.IsNil() || r.IsNil() {
-		return ErrorV("operand was nil")
+		return ctx.errorV("operand was nil")
 	}
 
 	switch n.op {
-	case "+":
-		return builder.CreateFAdd(l, r, "addtmp")
-	case "-":
-		return builder.CreateFSub(l, r, "subtmp")
-	case "*":
-		return builder.CreateFMul(l, r, "multmp")
-	case "/":
-		return builder.CreateFDiv(l, r, "divtmp")
-	case "<":
-		l = builder.CreateFCmp(llvm.FloatOLT, l, r, "cmptmp")
-		return builder.CreateUIToFP(l, llvm.DoubleType(), "booltmp")
+	case "^":
+		// llvm.pow.f64 becomes a call to pow, so programs using ^ need
+		// libm; it's linked into the JIT, and objects must be linked
+		// with -lm.
+		double := ctx.context.DoubleType()
+		if l, r = ctx.convert(l, double), ctx.convert(r, double); l.IsNil() || r.IsNil() {
+			return ctx.errorV("operands of ^ must be numbers")
+		}
+		pow := ctx.namedFunction("llvm.pow.f64", double, double, double)
+		return ctx.builder.CreateCall(pow, []llvm.Value{l, r}, ctx.tmp("pow"))
+	case "+", "-", "*", "/", "<", ">", "<=", ">=", "==", "!=":
 	default:
-		function := rootModule.NamedFunction("binary" + string(n.op))
+		function := ctx.module.NamedFunction("binary" + string(n.op))
 		if function.IsNil() {
-			return ErrorV("invalid binary operator")
+			return ctx.errorV("invalid binary operator")
+		}
+		l, r = ctx.convert(l, function.Param(0).Type()), ctx.convert(r, function.Param(1).Type())
+		if l.IsNil() || r.IsNil() {
+			return ctx.errorV("operands of binary" + n.op + " have the wrong types")
+		}
+		return ctx.builder.CreateCall(function, []llvm.Value{l, r}, ctx.tmp("binop"))
+	}
+
+	l, r = ctx.promoteBools(l, r)
+	if l.Type() != r.Type() {
+		return ctx.errorV(fmt.Sprintf("operands of %s have different types (%s and %s)",
+			n.op, ctx.typeName(l.Type()), ctx.typeName(r.Type())))
+	}
+
+	switch l.Type() {
+	case ctx.intType():
+		switch n.op {
+		case "+":
+			return ctx.builder.CreateAdd(l, r, ctx.tmp("add"))
+		case "-":
+			return ctx.builder.CreateSub(l, r, ctx.tmp("sub"))
+		case "*":
+			return ctx.builder.CreateMul(l, r, ctx.tmp("mul"))
+		case "/":
+			if ctx.trapDivZero && !ctx.checkDivisor(r, n.Pos) {
+				return llvm.Value{}
+			}
+			return ctx.builder.CreateSDiv(l, r, ctx.tmp("div"))
+		default:
+			return ctx.builder.CreateICmp(intPredicates[n.op], l, r, ctx.tmp("cmp"))
+		}
+	case ctx.context.DoubleType():
+		switch n.op {
+		case "+":
+			return ctx.builder.CreateFAdd(l, r, ctx.tmp("add"))
+		case "-":
+			return ctx.builder.CreateFSub(l, r, ctx.tmp("sub"))
+		case "*":
+			return ctx.builder.CreateFMul(l, r, ctx.tmp("mul"))
+		case "/":
+			if ctx.trapDivZero && !ctx.checkDivisor(r, n.Pos) {
+				return llvm.Value{}
+			}
+			return ctx.builder.CreateFDiv(l, r, ctx.tmp("div"))
+		default:
+			return ctx.builder.CreateFCmp(floatPredicates[n.op], l, r, ctx.tmp("cmp"))
 		}
-		return builder.CreateCall(function, []llvm.Value{l, r}, "binop")
 	}
+	return ctx.errorV("operands of " + n.op + " must be numbers")
 }
 
-func (n *fnPrototypeNode) codegen() llvm.Value {
+// codegenLogical generates code for && and ||, which only evaluate
+// their right operand if the left one doesn't decide the result. Like
+// comparisons, they evaluate to a boolean.
+func (n *binaryNode) codegenLogical(ctx *genContext) llvm.Value {
+	l := n.left.codegen(ctx)
+	if l.IsNil() {
+		return ctx.errorV("operand was nil")
+	}
+	lcond := ctx.condition(l, ctx.tmp("lhscond"))
+
+	parentFunc := ctx.builder.GetInsertBlock().Parent()
+	lhsBlk := ctx.builder.GetInsertBlock()
+	rhsBlk := ctx.context.AddBasicBlock(parentFunc, "rhs")
+	mergeBlk := ctx.context.AddBasicBlock(parentFunc, "logicmerge")
+
+	// the value when the left operand decides the result.
+	var decided llvm.Value
+	if n.op == "&&" {
+		ctx.builder.CreateCondBr(lcond, rhsBlk, mergeBlk)
+		decided = llvm.ConstInt(ctx.context.Int1Type(), 0, false)
+	} else {
+		ctx.builder.CreateCondBr(lcond, mergeBlk, rhsBlk)
+		decided = llvm.ConstInt(ctx.context.Int1Type(), 1, false)
+	}
+
+	ctx.builder.SetInsertPointAtEnd(rhsBlk)
+	r := n.right.codegen(ctx)
+	if r.IsNil() {
+		return ctx.errorV("operand was nil")
+	}
+	rcond := ctx.condition(r, ctx.tmp("rhscond"))
+	ctx.builder.CreateBr(mergeBlk)
+	// codegen of the right operand can change the current block.
+	rhsBlk = ctx.builder.GetInsertBlock()
+
+	ctx.builder.SetInsertPointAtEnd(mergeBlk)
+	phi := ctx.builder.CreatePHI(ctx.context.Int1Type(), ctx.tmp("logic"))
+	phi.AddIncoming([]llvm.Value{decided, rcond}, []llvm.BasicBlock{lhsBlk, rhsBlk})
+	return phi
+}
+
+// floatPredicates and intPredicates map the built-in comparison
+// operators to the predicates comparing their operands.
+var (
+	floatPredicates = map[string]llvm.FloatPredicate{
+		"<":  llvm.FloatOLT,
+		">":  llvm.FloatOGT,
+		"<=": llvm.FloatOLE,
+		">=": llvm.FloatOGE,
+		"==": llvm.FloatOEQ,
+		"!=": llvm.FloatONE,
+	}
+	intPredicates = map[string]llvm.IntPredicate{
+		"<":  llvm.IntSLT,
+		">":  llvm.IntSGT,
+		"<=": llvm.IntSLE,
+		">=": llvm.IntSGE,
+		"==": llvm.IntEQ,
+		"!=": llvm.IntNE,
+	}
+)
+
+func (n *fnPrototypeNode) codegen(ctx *genContext) llvm.Value {
 	funcArgs := []llvm.Type{}
-	for _ = range n.args {
-		funcArgs = append(funcArgs, llvm.DoubleType())
+	for _, t := range n.argTypes {
+		funcArgs = append(funcArgs, ctx.llvmType(t))
 	}
-	funcType := llvm.FunctionType(llvm.DoubleType(), funcArgs, false)
-	function := llvm.AddFunction(rootModule, n.name, funcType)
+	funcType := llvm.FunctionType(ctx.llvmType(n.retType), funcArgs, false)
+	function := llvm.AddFunction(ctx.module, n.name, funcType)
 
 	if function.Name() != n.name {
 		function.EraseFromParentAsFunction()
-		function = rootModule.NamedFunction(n.name)
+		function = ctx.module.NamedFunction(n.name)
 	}
 
-	if function.BasicBlocksCount() != 0 {
-		return ErrorV("redefinition of function: " + n.name)
+	// a function may be declared any number of times, before or after
+	// its definition, as long as the declarations agree.
+	if function.ParamsCount() != len(n.args) {
+		return ctx.errorV(fmt.Sprintf("%s takes %d argument(s), as first declared, not %d", n.name, function.ParamsCount(), len(n.args)))
 	}
 
-	if function.ParamsCount() != len(n.args) {
-		return ErrorV("redefinition of function with different number of args")
+	if function.Type().ElementType() != funcType {
+		return ctx.errorV(n.name + " has different types than first declared")
 	}
 
 	for i, param := range function.Params() {
 		param.SetName(n.args[i])
-		namedVals[n.args[i]] = param
+		ctx.namedVals[n.args[i]] = param
 	}
 
+	ctx.protos[n.name] = n
 	return function
 }
 
-func (n *functionNode) codegen() llvm.Value {
-	namedVals = make(map[string]llvm.Value)
+func (n *enumNode) codegen(ctx *genContext) llvm.Value {
+	seen := map[string]bool{}
+	for _, m := range n.members {
+		if _, ok := ctx.globalVals[m.name]; ok {
+			return ctx.errorCode(errRedefinition, n.Pos, "enum member "+m.name+" has the name of a global variable")
+		}
+		if _, ok := ctx.enumConsts[m.name]; ok || seen[m.name] {
+			return ctx.errorCode(errRedefinition, n.Pos, "redefinition of enum member "+m.name)
+		}
+		seen[m.name] = true
+	}
+	for _, m := range n.members {
+		ctx.enumConsts[m.name] = m.value
+	}
+	return llvm.ConstFloat(ctx.context.DoubleType(), float64(len(n.members)))
+}
+
+func (n *globalVarNode) codegen(ctx *genContext) llvm.Value {
+	var g llvm.Value
+	for _, v := range n.vars {
+		if _, ok := ctx.globalVals[v.name]; ok {
+			return ctx.errorCode(errRedefinition, n.Pos, "redefinition of global variable "+v.name)
+		}
+		if _, ok := ctx.enumConsts[v.name]; ok {
+			return ctx.errorCode(errRedefinition, n.Pos, "global variable "+v.name+" has the name of an enum member")
+		}
+
+		init := llvm.ConstFloat(ctx.context.DoubleType(), 0)
+		if v.size > 0 {
+			init = llvm.ConstNull(llvm.ArrayType(ctx.context.DoubleType(), v.size))
+		}
+		if v.node != nil {
+			lit := literal(v.node, ctx.intWidth)
+			if lit == nil {
+				return ctx.errorAt(v.node.Position(), "initializer of global variable "+v.name+" must be a constant")
+			}
+			if init = lit.codegen(ctx); init.IsNil() {
+				return init
+			}
+		}
+		g = llvm.AddGlobal(ctx.module, init.Type(), v.name)
+		g.SetInitializer(init)
+		ctx.globalVals[v.name] = g
+	}
+	return g
+}
+
+// markTailCalls marks the calls in tail position in body, the body of
+// a function, i.e. those whose results are returned directly, so that
+// they're generated as tail calls. With optimization, tail calls to the
+// function itself are turned into loops, so deep recursion doesn't
+// overflow the stack.
+func markTailCalls(body node) {
+	var mark func(n node)
+	mark = func(n node) {
+		switch n := n.(type) {
+		case *fnCallNode:
+			n.tail = true
+		case *ifNode:
+			mark(n.thenN)
+			mark(n.elseN)
+		case *blockNode:
+			mark(n.exprs[len(n.exprs)-1])
+		case *variableExprNode:
+			mark(n.body)
+		case *nestedFnNode:
+			mark(n.body)
+		}
+	}
+	mark(body)
+	Walk(body, func(n node) bool {
+		if r, ok := n.(*returnNode); ok {
+			mark(r.value)
+		}
+		return true
+	})
+}
+
+func (n *functionNode) codegen(ctx *genContext) llvm.Value {
+	ctx.namedVals = make(map[string]llvm.Value)
+	ctx.tmpCounts = map[string]int{}
+	ctx.loops = nil
 	p := n.proto.(*fnPrototypeNode)
-	theFunction := n.proto.codegen()
+	old := ctx.redefinable(p.name)
+	decl := ctx.calledDeclaration(p.name)
+	if !old.IsNil() || !decl.IsNil() {
+		// generate the new definition under another name; if it
+		// succeeds, the old one forwards to it, or the declaration's
+		// callers call it instead.
+		renamed := *p
+		for i := 1; !ctx.module.NamedFunction(renamed.name).IsNil(); i++ {
+			renamed.name = fmt.Sprintf("%s.%d", p.name, i)
+		}
+		p = &renamed
+	}
+	theFunction := p.codegen(ctx)
 	if theFunction.IsNil() {
-		return ErrorV("prototype")
+		return ctx.errorV("prototype")
+	}
+	if theFunction.BasicBlocksCount() != 0 {
+		return ctx.errorCode(errRedefinition, p.Pos, "redefinition of function: "+p.name)
+	}
+	if prior := old; !prior.IsNil() || !decl.IsNil() {
+		if prior.IsNil() {
+			prior = decl
+		}
+		if prior.Type() != theFunction.Type() {
+			theFunction.EraseFromParentAsFunction()
+			return ctx.errorV(prior.Name() + " has different types than first declared")
+		}
 	}
 
-	// if p.isOperator && len(p.args) == 2 {
-	// 	opChar, _ := utf8.DecodeLastRuneInString(p.name)
-	//  binaryOpPrecedence[opChar] = p.precedence
-	// }
-
-	block := llvm.AddBasicBlock(theFunction, "entry")
-	builder.SetInsertPointAtEnd(block)
+	block := ctx.context.AddBasicBlock(theFunction, "entry")
+	ctx.builder.SetInsertPointAtEnd(block)
 
-	p.createArgAlloca(theFunction)
+	p.createArgAlloca(ctx, theFunction)
+	if env := ctx.closure; env != nil {
+		ctx.closure = nil // not for functions nested in this one
+		ctx.openEnv(env)
+	}
+	defer func(guarded bool) { ctx.guarded = guarded }(ctx.guarded)
+	ctx.guarded = false
+	if ctx.stackGuard > 0 && p.name != "" && mayRecurse(n.body) {
+		ctx.guardStack(theFunction)
+	}
+	markTailCalls(n.body)
 
-	retVal := n.body.codegen()
+	retVal := n.body.codegen(ctx)
 	if retVal.IsNil() {
 		theFunction.EraseFromParentAsFunction()
-		return ErrorV("function body")
+		return ctx.errorV("function body")
 	}
 
-	builder.CreateRet(retVal)
+	// top-level expressions are always run as functions returning a
+	// double; integer results are passed back as the double's bits,
+	// sign-extended to 64 of them if ints are narrower.
+	if p.name == "" && retVal.Type() == ctx.intType() {
+		if ctx.intWidth < 64 {
+			retVal = ctx.builder.CreateSExt(retVal, ctx.context.Int64Type(), ctx.tmp("widened"))
+		}
+		retVal = ctx.builder.CreateBitCast(retVal, ctx.context.DoubleType(), ctx.tmp("intbits"))
+		n.intResult = true
+	}
+
+	if retVal = ctx.convert(retVal, theFunction.Type().ElementType().ReturnType()); retVal.IsNil() {
+		theFunction.EraseFromParentAsFunction()
+		return ctx.errorV("function body doesn't match the declared return type")
+	}
+
+	// if the body ended in a return, this ret is in its unreachable
+	// "afterreturn" block, so the block is never left unterminated.
+	ctx.ret(retVal)
 	if llvm.VerifyFunction(theFunction, llvm.PrintMessageAction) != nil {
 		theFunction.EraseFromParentAsFunction()
-		return ErrorV("function verifiction failed")
+		return ctx.errorV("function verifiction failed")
+	}
+	if !decl.IsNil() {
+		ctx.define(decl, theFunction)
 	}
 
-	rootFuncPassMgr.RunFunc(theFunction)
+	if ctx.unoptIR != nil {
+		ctx.unoptIR.WriteString(theFunction.String())
+	}
+	if ctx.stats != nil {
+		ctx.stats.addUnopt(theFunction)
+	}
+	ctx.funcPassMgr.RunFunc(theFunction)
+	if p.name != "" {
+		ctx.moduleChanged = true
+	}
+	if ctx.optIR != nil {
+		ctx.optIR.WriteString(theFunction.String())
+	}
+	if !old.IsNil() {
+		ctx.forward(old, theFunction)
+	}
 	return theFunction
 }
+
+// The stack guard counts the depth of calls to guarded functions in the
+// global stackDepth. When a call would be too deep, it's refused: the
+// function returns zero at once, having set stackOverflowed, and so do
+// all calls until the expression running has finished, which then
+// fails; see Step. Runaway recursion thus unwinds rather than
+// overflowing the stack and taking the process with it. The globals
+// aren't thread-local, as only one expression runs at a time.
+const (
+	stackDepth      = "stack.depth"
+	stackOverflowed = "stack.overflowed"
+)
+
+// mayRecurse reports whether body calls a function or user operator,
+// through which the function whose body it is might be called again.
+func mayRecurse(body node) bool {
+	calls := false
+	Walk(body, func(n node) bool {
+		switch n := n.(type) {
+		case *fnCallNode:
+			calls = true
+		case *unaryNode:
+			calls = calls || n.name != "-"
+		case *binaryNode:
+			_, builtin := builtinPrecedence[n.op]
+			calls = calls || !builtin
+		}
+		return !calls
+	})
+	return calls
+}
+
+// stackGlobal returns the stack guard's global name, an i64, defining
+// it as 0 if need be.
+func (ctx *genContext) stackGlobal(name string) llvm.Value {
+	if g := ctx.module.NamedGlobal(name); !g.IsNil() {
+		return g
+	}
+	g := llvm.AddGlobal(ctx.module, ctx.context.Int64Type(), name)
+	g.SetInitializer(llvm.ConstInt(ctx.context.Int64Type(), 0, false))
+	return g
+}
+
+// guardStack begins f with the stack guard's check, counting the call
+// in stackDepth unless it's refused. ret undoes the count.
+func (ctx *genContext) guardStack(f llvm.Value) {
+	i64 := ctx.context.Int64Type()
+	depth, overflowed := ctx.stackGlobal(stackDepth), ctx.stackGlobal(stackOverflowed)
+	d := ctx.builder.CreateAdd(ctx.builder.CreateLoad(depth, ctx.tmp("depth")), llvm.ConstInt(i64, 1, false), ctx.tmp("depth"))
+	tooDeep := ctx.builder.CreateICmp(llvm.IntSGT, d, llvm.ConstInt(i64, uint64(ctx.stackGuard), false), ctx.tmp("toodeep"))
+	refused := ctx.builder.CreateICmp(llvm.IntNE, ctx.builder.CreateLoad(overflowed, ctx.tmp("overflowed")),
+		llvm.ConstInt(i64, 0, false), ctx.tmp("refused"))
+	overflowBlk := ctx.context.AddBasicBlock(f, "overflow")
+	guardedBlk := ctx.context.AddBasicBlock(f, "guarded")
+	ctx.builder.CreateCondBr(ctx.builder.CreateOr(tooDeep, refused, ctx.tmp("refuse")), overflowBlk, guardedBlk)
+
+	ctx.builder.SetInsertPointAtEnd(overflowBlk)
+	ctx.builder.CreateStore(llvm.ConstInt(i64, 1, false), overflowed)
+	ctx.builder.CreateRet(llvm.ConstNull(f.Type().ElementType().ReturnType()))
+
+	ctx.builder.SetInsertPointAtEnd(guardedBlk)
+	ctx.builder.CreateStore(d, depth)
+	ctx.guarded = true
+}
+
+// ret returns v from the function being generated, first taking it out
+// of the call depth if the stack guard counted it.
+func (ctx *genContext) ret(v llvm.Value) {
+	if ctx.guarded {
+		depth := ctx.stackGlobal(stackDepth)
+		d := ctx.builder.CreateLoad(depth, ctx.tmp("depth"))
+		ctx.builder.CreateStore(ctx.builder.CreateSub(d, llvm.ConstInt(ctx.context.Int64Type(), 1, false), ctx.tmp("depth")), depth)
+	}
+	ctx.builder.CreateRet(v)
+}
+
+// overflowed reports whether the stack guard refused a call while
+// the last expression ran, resetting the guard for the next.
+func (ctx *genContext) overflowed() bool {
+	g := ctx.module.NamedGlobal(stackOverflowed)
+	if g.IsNil() {
+		return false
+	}
+	overflowed := (*int64)(ctx.execEngine.PointerToGlobal(g))
+	depth := (*int64)(ctx.execEngine.PointerToGlobal(ctx.stackGlobal(stackDepth)))
+	defer func() { *overflowed, *depth = 0, 0 }()
+	return *overflowed != 0
+}
+
+// redefinable returns the function name if it's already defined and
+// may be replaced by a new definition, or nil.
+func (ctx *genContext) redefinable(name string) llvm.Value {
+	if !ctx.redefine || name == "" {
+		return llvm.Value{}
+	}
+	f := ctx.module.NamedFunction(name)
+	if f.IsNil() || f.BasicBlocksCount() == 0 {
+		return llvm.Value{}
+	}
+	return f
+}
+
+// calledDeclaration returns the function name if it's declared, say by
+// an extern, but not yet defined, and code calling it has already been
+// generated, or nil. Such a declaration can't be erased should its
+// definition fail, so the definition is generated apart; see define.
+func (ctx *genContext) calledDeclaration(name string) llvm.Value {
+	if name == "" {
+		return llvm.Value{}
+	}
+	f := ctx.module.NamedFunction(name)
+	if f.IsNil() || f.BasicBlocksCount() != 0 || f.FirstUse().IsNil() {
+		return llvm.Value{}
+	}
+	return f
+}
+
+// define makes f, a new definition of the same type as decl, replace
+// decl, a declaration, everywhere it's used, and gives f decl's name.
+func (ctx *genContext) define(decl, f llvm.Value) {
+	name := decl.Name()
+	decl.ReplaceAllUsesWith(f)
+	decl.EraseFromParentAsFunction()
+	f.SetName(name)
+}
+
+// forward replaces the body of old, a defined function, with a call to
+// f, which has the same type, and has the JIT recompile it. Code that
+// calls old, including code already compiled, then calls f. If old
+// forwarded to an earlier definition, that one is no longer called and
+// is deleted, so redefining a function again and again doesn't leave a
+// version of it behind each time.
+func (ctx *genContext) forward(old, f llvm.Value) {
+	eraseBody(old)
+	ctx.builder.SetInsertPointAtEnd(ctx.context.AddBasicBlock(old, "forward"))
+	call := ctx.builder.CreateCall(f, old.Params(), "")
+	call.SetTailCall(true)
+	ctx.builder.CreateRet(call)
+	ctx.funcPassMgr.RunFunc(old)
+	ctx.execEngine.RecompileAndRelinkFunction(old)
+
+	if stale := ctx.versions[old.Name()]; !stale.IsNil() {
+		ctx.execEngine.FreeMachineCodeForFunction(stale)
+		stale.EraseFromParentAsFunction()
+	}
+	ctx.versions[old.Name()] = f
+}
+
+// eraseBody deletes the blocks of f, leaving it a declaration. As they
+// may refer to one another, their instructions' uses are replaced and
+// the instructions deleted first.
+func eraseBody(f llvm.Value) {
+	for bb := f.FirstBasicBlock(); !bb.IsNil(); bb = bb.NextBasicBlock() {
+		for i := bb.FirstInstruction(); !i.IsNil(); i = i.NextInstruction() {
+			if !i.FirstUse().IsNil() {
+				i.ReplaceAllUsesWith(llvm.Undef(i.Type()))
+			}
+		}
+	}
+	for bb := f.FirstBasicBlock(); !bb.IsNil(); bb = f.FirstBasicBlock() {
+		for i := bb.FirstInstruction(); !i.IsNil(); i = bb.FirstInstruction() {
+			i.EraseFromParentAsInstruction()
+		}
+		bb.EraseFromParent()
+	}
+}
@@ -0,0 +1,110 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestArgTypes checks that arguments of the declared types are
+// accepted, and that a string or a handle of another opaque type passed
+// for a FILE is an error naming the types.
+func TestArgTypes(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	const decls = `extern type FILE; extern type DIR
+extern fdopen(fd: int, mode: string): FILE; extern fileno(f: FILE): int; extern opendir(name: string): DIR
+`
+	if err := e.Compile(decls + `fileno(fdopen(2i, "w"))`); err != nil {
+		t.Fatal(err)
+	}
+	for arg, typ := range map[string]string{`"stderr"`: "string", `opendir(".")`: "DIR"} {
+		err := e.Compile(decls + "fileno(" + arg + ")")
+		want := "argument 1 (f) of fileno has type " + typ + ", expected FILE"
+		if ds, ok := err.(Diagnostics); !ok || ds[0].Message != want {
+			t.Errorf("passing %s for a FILE gave %v, want %q", arg, err, want)
+		}
+	}
+}
+
+// TestBoundsCheck checks that an index past the end of an array aborts
+// the program with BoundsCheck, and doesn't without it.
+func TestBoundsCheck(t *testing.T) {
+	const src = "var cells[4]\ndef get(i) cells[i]\nget(4)"
+	if out, err := runAlone(t, src, Options{}); err != nil {
+		t.Errorf("without BoundsCheck, got %v:\n%s", err, out)
+	}
+	out, err := runAlone(t, src, Options{BoundsCheck: true})
+	if err == nil || !strings.Contains(out, "index out of range for array cells") {
+		t.Errorf("with BoundsCheck, got %v:\n%s", err, out)
+	}
+}
+
+// TestRedefine checks that with Redefine, each definition of a function
+// replaces the last, leaving at most one earlier version in the module,
+// and that without it a second definition is an error.
+func TestRedefine(t *testing.T) {
+	e := newTestEngine(t, Options{Redefine: true})
+	for i := 1; i <= 3; i++ {
+		if err := e.Compile(fmt.Sprintf("def foo(x) x + %d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := e.Run("foo(1)"); err != nil || got != float64(1+i) {
+			t.Errorf("after definition %d, foo(1) gave %v, %v, want %d", i, got, err, 1+i)
+		}
+	}
+	var versions []string
+	for f := e.ctx.module.FirstFunction(); !f.IsNil(); f = f.NextFunction() {
+		if strings.HasPrefix(f.Name(), "foo.") {
+			versions = append(versions, f.Name())
+		}
+	}
+	if len(versions) > 1 {
+		t.Errorf("the module has the versions %q, want one", versions)
+	}
+
+	e = newTestEngine(t, Options{})
+	err := e.Compile("def foo(x) x + 1\ndef foo(x) x + 2")
+	if ds, ok := err.(Diagnostics); !ok || ds[0].Code != errRedefinition {
+		t.Errorf("without Redefine, got %v, want error %s", err, errRedefinition)
+	}
+}
+
+// TestTrapDivZero checks that dividing by zero aborts the program with
+// TrapDivZero, and gives infinity without it, and that a program's own
+// puts isn't called in place of the C library's.
+func TestTrapDivZero(t *testing.T) {
+	const src = "def div(x, y) x / y\ndiv(1, 0)"
+	if out, err := runAlone(t, src, Options{}); err != nil || !strings.Contains(out, "+Inf") {
+		t.Errorf("without TrapDivZero, got %v:\n%s", err, out)
+	}
+	out, err := runAlone(t, src, Options{TrapDivZero: true})
+	if err == nil || !strings.Contains(out, "division by zero") {
+		t.Errorf("with TrapDivZero, got %v:\n%s", err, out)
+	}
+
+	e := newTestEngine(t, Options{TrapDivZero: true})
+	e.Compile("def puts(x) x\ndef div(x, y) x / y")
+	want := "run-time checks need the C library's puts and abort, but the program defines its own"
+	if ds := e.Diagnostics(); len(ds) == 0 || ds[0].Message != want {
+		t.Errorf("with a puts of its own, got %v, want %q", ds, want)
+	}
+}
+
+// TestErrorCodePositions checks that errors with a diagnostic code name
+// the offending identifier and give its position.
+func TestErrorCodePositions(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want Diagnostic
+	}{
+		{"1 + nosuch(2)", Diagnostic{Pos: 4, Severity: SeverityError, Code: errUnknownFunction, Message: "unknown function referenced: nosuch"}},
+		{"def f(x) x\n1 + f(1, 2)", Diagnostic{Pos: 4, Severity: SeverityError, Code: errArgCount, Message: "incorrect number of arguments passed to f"}},
+		{"def f(x) x\ndef f(y) y", Diagnostic{Pos: 4, Severity: SeverityError, Code: errRedefinition, Message: "redefinition of function: f"}},
+	} {
+		e := newTestEngine(t, Options{})
+		e.Compile(tc.src)
+		if ds := e.Diagnostics(); len(ds) == 0 || ds[0] != tc.want {
+			t.Errorf("compiling %q reported %v, want %v", tc.src, ds, tc.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Severity is how serious a Diagnostic is.
+type Severity int
+
+const (
+	SeverityError   Severity = iota // the statement couldn't be compiled
+	SeverityWarning                 // the statement compiled, but is probably wrong
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// NoPos is the Pos of a Diagnostic that isn't about any particular
+// code.
+const NoPos Pos = -1
+
+// Diagnostic is an error or warning reported about a program.
+type Diagnostic struct {
+	Pos      Pos // the position of the offending code, or NoPos
+	Severity Severity
+	Code     string // the error code, e.g. "E001", if there is one; see Explain
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	s := d.Severity.String()
+	if d.Code != "" {
+		s += "[" + d.Code + "]"
+	}
+	if d.Pos != NoPos {
+		s += fmt.Sprintf(" at %v", d.Pos)
+	}
+	return s + ": " + d.Message
+}
+
+// Diagnostics is a list of diagnostics, which Compile returns as its
+// error if it reports any errors.
+type Diagnostics []Diagnostic
+
+func (l Diagnostics) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].String()
+	}
+	return fmt.Sprintf("%v (and %d more)", l[0], len(l)-1)
+}
+
+// diagnosticLog collects the diagnostics reported for an Engine. The
+// parser reports them from its own goroutine, so it's locked. A nil
+// *diagnosticLog collects nothing.
+type diagnosticLog struct {
+	mu    sync.Mutex
+	list  []Diagnostic
+	quiet bool // don't print diagnostics to stderr, for Options.QuietDiagnostics
+
+	werror   bool // report warnings as errors, for Options.WarningsAsErrors
+	promoted int  // the number of warnings reported as errors since the last reset
+
+	// the number of syntax errors reported since the last reset, so
+	// that callers of parse can tell whether any statements were
+	// dropped.
+	syntax int
+}
+
+// report adds d to l and, unless l is quiet, prints text, which
+// describes d, to stderr.
+func (l *diagnosticLog) report(d Diagnostic, text string) {
+	if l == nil {
+		fmt.Fprint(os.Stderr, text)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list = append(l.list, d)
+	if !l.quiet {
+		fmt.Fprint(os.Stderr, text)
+	}
+}
+
+// reset forgets the diagnostics reported so far.
+func (l *diagnosticLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list, l.promoted, l.syntax = nil, 0, 0
+}
+
+// all returns the diagnostics reported since the last reset.
+func (l *diagnosticLog) all() []Diagnostic {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Diagnostic(nil), l.list...)
+}
+
+// promotedWarnings returns the number of warnings reported as errors
+// since the last reset.
+func (l *diagnosticLog) promotedWarnings() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.promoted
+}
+
+// syntaxErrors returns the number of syntax errors reported since the
+// last reset.
+func (l *diagnosticLog) syntaxErrors() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syntax
+}
+
+// errors returns the errors reported since the last reset, or nil if
+// there weren't any.
+func (l *diagnosticLog) errors() Diagnostics {
+	var errs Diagnostics
+	for _, d := range l.all() {
+		if d.Severity == SeverityError {
+			errs = append(errs, d)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,281 @@
+package kaleidoscope
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Engine compiles Kaleidoscope source and runs it with LLVM's JIT.
+// Functions defined by one call to Compile or Run may be called by
+// later ones. Each Engine has its own module and JIT, so separate
+// Engines may be used from different goroutines, though an Engine must
+// not be used from more than one goroutine at a time.
+type Engine struct {
+	*CodeGenContext
+	opts     Options
+	resolver *resolver      // the names defined so far, for Check
+	diags    *diagnosticLog // the diagnostics reported by the last call; see Diagnostics
+}
+
+// NewEngine creates an Engine configured by opts.
+func NewEngine(opts Options) (*Engine, error) {
+	switch opts.IntWidth {
+	case 0, 8, 16, 32, 64:
+	default:
+		return nil, fmt.Errorf("an int can't be %d bits wide; use 8, 16, 32 or 64", opts.IntWidth)
+	}
+	if err := checkPrecedences(opts.Precedence); err != nil {
+		return nil, err
+	}
+	ctx, err := newGenContext()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Time && opts.Profile == nil {
+		opts.Profile = &Profile{} // for the per-statement times
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	began := time.Now()
+	ctx.optimize(opts.OptLevel)
+	if opts.Profile != nil {
+		opts.Profile.Optimize = time.Since(began)
+	}
+	if opts.Time {
+		fmt.Fprintf(os.Stderr, "time: optimize setup %v\n", opts.Profile.Optimize)
+	}
+	ctx.stats = opts.Stats
+	ctx.boundsCheck = opts.BoundsCheck
+	ctx.trapDivZero = opts.TrapDivZero
+	ctx.redefine = opts.Redefine
+	if opts.IntWidth != 0 {
+		ctx.intWidth = opts.IntWidth
+	}
+	ctx.stackGuard = opts.StackGuard
+	ctx.diagnosticLog = &diagnosticLog{quiet: opts.QuietDiagnostics, werror: opts.WarningsAsErrors}
+	c := &CodeGenContext{
+		ctx:            ctx,
+		operators:      newPrecedenceTable(opts.Precedence),
+		printLLVMIR:    opts.PrintLLVMIR,
+		peephole:       opts.Peephole,
+		unsafePeephole: opts.UnsafePeephole,
+		timeout:        opts.Timeout,
+	}
+	if opts.Memoize {
+		c.memo = map[[32]byte]memoEntry{}
+	}
+	if opts.Profile != nil {
+		c.codegenClock.total = &opts.Profile.Codegen
+		c.execClock.total = &opts.Profile.Exec
+	}
+	r := newResolver()
+	r.warnUnused = opts.WarnUnused
+	r.diags = ctx.diagnosticLog
+	return &Engine{c, opts, r, ctx.diagnosticLog}, nil
+}
+
+// Input is a named source of Kaleidoscope code. The name is used in
+// error messages.
+type Input struct {
+	Name string
+	R    io.Reader
+}
+
+// Compile generates code for every statement in src without running
+// any of them. Definitions and extern declarations become available to
+// later calls; top-level expressions are compiled but never run. It
+// returns the errors reported as Diagnostics, if there were any, or
+// else the first error found, though the rest of src is still compiled.
+func (e *Engine) Compile(src string) error {
+	var first error
+	err := e.each(src, func(n node) {
+		if _, err := e.compile(n); err != nil && first == nil {
+			first = err
+		}
+	})
+	if errs := e.diags.errors(); errs != nil {
+		return errs
+	}
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// Run compiles and runs each statement of src in turn, returning the
+// value of the last top-level expression. It stops at the first error.
+func (e *Engine) Run(src string) (float64, error) {
+	var (
+		last  *Result
+		first error
+	)
+	err := e.each(src, func(n node) {
+		if first != nil {
+			return
+		}
+		result, err := e.Step(n)
+		if err != nil {
+			first = err
+		}
+		if result != nil {
+			last = result
+		}
+	})
+	switch {
+	case first != nil:
+		return 0, first
+	case err != nil:
+		return 0, err
+	case last == nil:
+		return 0, errors.New("no expression was evaluated")
+	}
+	return last.Float64(), nil
+}
+
+// each parses src, calling fn on each top-level statement. It returns
+// an error if any statements couldn't be parsed; their errors will
+// have been printed.
+func (e *Engine) each(src string, fn func(node)) error {
+	e.diags.reset()
+	l := lexSource("", src, e.opts)
+	for n := range parse(l.Tokens(), e.opts, e.operators, e.diags) {
+		fn(n)
+	}
+	if n := e.diags.syntaxErrors(); n > 0 {
+		return fmt.Errorf("%d syntax error(s)", n)
+	}
+	return nil
+}
+
+// Interpret runs the inputs as a single program, as the command does:
+// each statement is compiled and run as soon as it is read (or, with
+// WholeProgram, once all of them have been), and the results of
+// top-level expressions are printed to stdout. Errors are printed to
+// stderr as they're found and don't stop the program. An error is
+// returned only if warnings were promoted to errors.
+func (e *Engine) Interpret(inputs ...Input) error {
+	e.diags.reset()
+	tokens := e.lex(inputs).Tokens()
+	if e.opts.PrintTokens {
+		tokens = DumpTokens(tokens)
+	}
+	nodes := parse(tokens, e.opts, e.operators, e.diags)
+	if e.opts.PrintAST {
+		nodes = DumpTree(nodes)
+	}
+	if e.opts.WarnUnused {
+		nodes = warnUnused(nodes, e.diags)
+	}
+	if e.opts.Serial {
+		nodes = drain(nodes)
+	}
+	e.exec(nodes)
+	if n := e.diags.promotedWarnings(); n > 0 {
+		return fmt.Errorf("%d warning(s) treated as errors", n)
+	}
+	return nil
+}
+
+// Diagnostics returns the errors and warnings reported by the last call
+// to Compile, Run, Check or Interpret, in the order they were found.
+// They're also printed to stderr unless Options.QuietDiagnostics is set.
+func (e *Engine) Diagnostics() []Diagnostic {
+	return e.diags.all()
+}
+
+// Precedences returns the binary operators defined so far, both built
+// in and user-defined, mapped to their precedences. Higher precedences
+// bind more tightly.
+func (e *Engine) Precedences() map[string]int {
+	return e.operators.copy()
+}
+
+// Function describes a function defined or declared extern.
+type Function struct {
+	Name   string
+	Params int
+	Extern bool // declared but not defined
+}
+
+// Functions returns the functions defined or declared so far, in the
+// order they were first declared. Top-level expressions and nested
+// functions aren't included.
+func (e *Engine) Functions() []Function {
+	var fns []Function
+	for f := e.ctx.module.FirstFunction(); !f.IsNil(); f = f.NextFunction() {
+		// nested functions' mangled names contain dots.
+		if f.Name() == "" || strings.Contains(f.Name(), ".") {
+			continue
+		}
+		fns = append(fns, Function{f.Name(), f.ParamsCount(), f.IsDeclaration()})
+	}
+	return fns
+}
+
+// warnUnused passes on the nodes from in, first warning about the
+// variables and parameters in each that are never used. Undefined names
+// are left for code generation to report.
+func warnUnused(in <-chan node, diags *diagnosticLog) <-chan node {
+	r := newResolver()
+	r.quiet, r.warnUnused, r.diags = true, true, diags
+	out := make(chan node)
+	go func() {
+		for n := range in {
+			r.declare(n)
+			r.resolve(n)
+			out <- n
+		}
+		close(out)
+	}()
+	return out
+}
+
+// drain reads every node from in before returning them on a channel of
+// their own, so that nothing is executed until all the input has been
+// lexed and parsed.
+func drain(in <-chan node) <-chan node {
+	var all []node
+	for n := range in {
+		all = append(all, n)
+	}
+	out := make(chan node, len(all))
+	for _, n := range all {
+		out <- n
+	}
+	close(out)
+	return out
+}
+
+// WriteTokensJSON lexes the inputs, writing their tokens to w as a
+// JSON array.
+func (e *Engine) WriteTokensJSON(w io.Writer, inputs ...Input) error {
+	return WriteTokensJSON(w, e.lex(inputs).Tokens())
+}
+
+// WriteASTJSON parses the inputs, writing their top-level statements'
+// ASTs to w as a JSON array; see the package-level WriteASTJSON.
+func (e *Engine) WriteASTJSON(w io.Writer, inputs ...Input) error {
+	return WriteASTJSON(w, parse(e.lex(inputs).Tokens(), e.opts, e.operators, e.diags))
+}
+
+// lex starts a lexer over the inputs.
+func (e *Engine) lex(inputs []Input) *lexer {
+	l := Lex(e.opts)
+	// operators defined by earlier calls are still operators. The
+	// lexer won't read them until it's given its first input.
+	for r, kind := range e.operators.userOperators() {
+		l.userOperators[r] = kind
+	}
+	go func() {
+		for _, in := range inputs {
+			l.AddReader(in.Name, in.R)
+		}
+		l.Done()
+	}()
+	return l
+}
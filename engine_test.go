@@ -0,0 +1,244 @@
+package kaleidoscope
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestEngine returns an Engine with opts that collects its
+// diagnostics without printing them, failing the test if it can't be
+// created.
+func newTestEngine(t *testing.T, opts Options) *Engine {
+	t.Helper()
+	opts.QuietDiagnostics = true
+	e, err := NewEngine(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// The environment variables with which runAlone passes a child process
+// the program to run and its options, as JSON.
+const (
+	aloneSrcEnv  = "KALEIDOSCOPE_TEST_SRC"
+	aloneOptsEnv = "KALEIDOSCOPE_TEST_OPTS"
+)
+
+func TestMain(m *testing.M) {
+	if src, ok := os.LookupEnv(aloneSrcEnv); ok {
+		os.Exit(runChild(src, os.Getenv(aloneOptsEnv)))
+	}
+	os.Exit(m.Run())
+}
+
+// runAlone runs src with opts in a child process, since a program that
+// aborts takes the process running it down too. It returns what the
+// child printed and, if it didn't exit cleanly, why.
+func runAlone(t *testing.T, src string, opts Options) (string, error) {
+	t.Helper()
+	js, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), aloneSrcEnv+"="+src, aloneOptsEnv+"="+string(js))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// runChild runs src with the options encoded in js, printing the
+// result, and returns the process's exit status.
+func runChild(src, js string) int {
+	var opts Options
+	if err := json.Unmarshal([]byte(js), &opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	e, err := NewEngine(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	v, err := e.Run(src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(v)
+	return 0
+}
+
+// readFile returns the contents of the file name, failing the test if
+// it can't be read.
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// interpret runs src as a program named name with e.Interpret,
+// failing the test if it returns an error.
+func interpret(t *testing.T, e *Engine, name, src string) {
+	t.Helper()
+	if err := e.Interpret(Input{name, strings.NewReader(src)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	var out bytes.Buffer
+	e := newTestEngine(t, Options{Output: &out})
+	interpret(t, e, "discard.k", "discard 1+1\n")
+	if out.Len() != 0 {
+		t.Errorf("discard 1+1 printed %q, want nothing", out.String())
+	}
+	interpret(t, e, "kept.k", "1+1\n")
+	if got := out.String(); got != "2\n" {
+		t.Errorf("1+1 printed %q, want \"2\\n\"", got)
+	}
+}
+
+// TestStep steps through a definition and then an expression using it.
+func TestStep(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	var results []*Result
+	err := e.each("def square(x) x * x\nsquare(3)", func(n node) {
+		r, err := e.Step(n)
+		if err != nil {
+			t.Error(err)
+		}
+		results = append(results, r)
+	})
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case len(results) != 2:
+		t.Fatalf("stepped through %d statements, want 2", len(results))
+	case results[0] != nil:
+		t.Errorf("the definition gave %v, want no result", *results[0])
+	case results[1] == nil || results[1].Float64() != 9:
+		t.Errorf("the expression gave %v, want 9", results[1])
+	}
+}
+
+// TestIsDefined checks that a function is defined only once its
+// definition has been compiled, and that globals are defined too.
+func TestIsDefined(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	if e.IsDefined("defined") {
+		t.Errorf("defined is defined before its definition")
+	}
+	if err := e.Compile("def defined(x) x"); err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsDefined("defined") {
+		t.Errorf("defined isn't defined after its definition")
+	}
+	if err := e.Compile("var global = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsDefined("global") {
+		t.Errorf("the global isn't defined after its declaration")
+	}
+}
+
+// TestRequireSemicolons checks that with RequireSemicolons, statements
+// ending in ';' run and one that doesn't is a syntax error.
+func TestRequireSemicolons(t *testing.T) {
+	e := newTestEngine(t, Options{RequireSemicolons: true})
+	if got, err := e.Run("def semi(x) x + 1; semi(1);"); err != nil || got != 2 {
+		t.Errorf("with semicolons, got %v, %v, want 2", got, err)
+	}
+	if _, err := e.Run("def nosemi(x) x\nnosemi(1);"); err == nil {
+		t.Errorf("a definition without a semicolon was accepted")
+	}
+}
+
+// TestLink checks that with WholeProgram, functions in two files may
+// call each other without externs, and that a function defined in both
+// is an error.
+func TestLink(t *testing.T) {
+	e := newTestEngine(t, Options{WholeProgram: true})
+	run := func(a, b string) (*Result, error) {
+		e.diags.reset()
+		inputs := []Input{{"a.k", strings.NewReader(a)}, {"b.k", strings.NewReader(b)}}
+		var last *Result
+		for n := range e.link(parse(e.lex(inputs).Tokens(), e.opts, e.operators, e.diags)) {
+			r, err := e.Step(n)
+			if err != nil {
+				return nil, err
+			}
+			if r != nil {
+				last = r
+			}
+		}
+		return last, nil
+	}
+	r, err := run("def even(n) if n == 0 then 1 else odd(n - 1)\n",
+		"def odd(n) if n == 0 then 0 else even(n - 1)\nodd(7)\n")
+	if err != nil || r == nil || r.Float64() != 1 {
+		t.Errorf("calling across files gave %v, %v, want 1", r, err)
+	}
+	run("def dup(x) x\n", "def dup(x) 2 * x\n")
+	if ds := e.Diagnostics(); len(ds) != 1 || ds[0].Code != errRedefinition {
+		t.Errorf("defining a function in both files gave %v, want a redefinition error", ds)
+	}
+}
+
+// TestWarningsAsErrors checks that an unused variable only fails a
+// program when warnings are errors.
+func TestWarningsAsErrors(t *testing.T) {
+	for _, werror := range []bool{false, true} {
+		e := newTestEngine(t, Options{WarnUnused: true, WarningsAsErrors: werror})
+		err := e.Interpret(Input{"unused.k", strings.NewReader("def unused(x) var y = 1 in x")})
+		if failed := err != nil; failed != werror {
+			t.Errorf("with WarningsAsErrors %v, got %v", werror, err)
+		}
+	}
+}
+
+func TestKeywordNames(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	for src, want := range map[string]string{
+		"def for(x) x":             "cannot use keyword 'for' as a function name",
+		"def twice(then) 2 * then": "cannot use keyword 'then' as an argument name",
+		"var var = 1 in 2":         "cannot use keyword 'var' as a variable name",
+	} {
+		e.Compile(src)
+		if ds := e.Diagnostics(); len(ds) == 0 || ds[0].Message != want {
+			t.Errorf("%s gave %v, want %q", src, ds, want)
+		}
+	}
+}
+
+// TestDiagnostics checks the position, severity and code of the
+// diagnostics Compile returns, and that warnings aren't among them.
+func TestDiagnostics(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	err := e.Compile("def (x) x")
+	want := Diagnostics{{Pos: 4, Severity: SeverityError, Message: "expected function name in prototype"}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("a definition without a name gave %#v, want %#v", err, want)
+	}
+	err = e.Compile("def redef(x) x\ndef redef(x) x")
+	if ds, ok := err.(Diagnostics); !ok || ds[0].Severity != SeverityError || ds[0].Code != errRedefinition {
+		t.Errorf("a redefinition gave %v, want error %s", err, errRedefinition)
+	}
+	if err := e.Compile("def warn(x) x / 0"); err != nil {
+		t.Errorf("a warning failed Compile: %v", err)
+	}
+	if ds := e.Diagnostics(); len(ds) != 1 || ds[0].Severity != SeverityWarning {
+		t.Errorf("division by zero gave %v, want a warning", ds)
+	}
+}
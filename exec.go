@@ -1,29 +1,378 @@
-package main
+package kaleidoscope
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"time"
 
 	"github.com/ajsnow/llvm"
 )
 
-// Exec JIT-compiles the top level statements in the roots chan and,
-// if they are expressions, executes them.
-func Exec(roots <-chan node, printLLVMIR bool) {
+// CodeGenContext drives code generation and JIT execution of
+// top-level statements one at a time.
+type CodeGenContext struct {
+	ctx       *genContext      // the module and JIT that statements are compiled into
+	operators *precedenceTable // binary operator precedences, kept between parses
+
+	printLLVMIR  bool      // dump the IR generated for each statement
+	codegenClock stopwatch // time spent generating code, for profiling
+	execClock    stopwatch // time spent running code, for profiling
+
+	peephole       bool // simplify the AST before code generation
+	unsafePeephole bool // including rewrites that change float semantics
+
+	timeout   time.Duration // limit on each expression's run time; 0 for none
+	abandoned bool          // an expression timed out and may still be running
+
+	// if non-nil, the code compiled for top-level expressions, which is
+	// reused when the same expression is given again.
+	memo map[[32]byte]memoEntry
+}
+
+// Result is the value of a top-level expression.
+type Result struct {
+	Float float64
+	Int   int64
+	IsInt bool // the expression is an integer; Int holds its value
+}
+
+// Float64 returns the value of r as a float64.
+func (r Result) Float64() float64 {
+	if r.IsInt {
+		return float64(r.Int)
+	}
+	return r.Float
+}
+
+// exec JIT-compiles the top level statements in the roots chan and,
+// if they are expressions, executes them, printing their results.
+func (e *Engine) exec(roots <-chan node) {
+	c, opts := e.CodeGenContext, e.opts
+	if opts.Stats != nil {
+		defer opts.Stats.count(c.ctx.module)
+	}
+	if opts.EmitLLVMBoth != "" {
+		c.ctx.unoptIR, c.ctx.optIR = &bytes.Buffer{}, &bytes.Buffer{}
+		defer c.ctx.writeLLVMBoth(opts.EmitLLVMBoth)
+	}
+	if opts.EmitLLVM != "" {
+		defer c.ctx.writeLLVM(opts.EmitLLVM)
+	}
+	if opts.EmitBitcode != "" {
+		defer c.ctx.writeBitcode(opts.EmitBitcode)
+	}
+	if (opts.EmitLLVM != "" || opts.EmitBitcode != "") && opts.ObjectFile == "" {
+		// the program has run by the time the module is written, so
+		// its dead functions can go. This is deferred last so that
+		// it's done first.
+		defer c.ctx.removeDeadFunctions()
+	}
+	if opts.WholeProgram {
+		roots = c.link(roots)
+	}
+	if opts.ObjectFile != "" {
+		c.compileObject(roots, opts.ObjectFile)
+		return
+	}
 	for n := range roots {
-		llvmIR := n.codegen()
-		if llvmIR.IsNil() {
-			fmt.Fprintln(os.Stderr, "Error: Codegen failed; skipping.")
+		var before Profile
+		if opts.Time {
+			before = *opts.Profile
+		}
+		result, err := c.Step(n)
+		if opts.Time {
+			fmt.Fprintf(os.Stderr, "time: %s: codegen %v, exec %v\n", describe(n),
+				opts.Profile.Codegen-before.Codegen, opts.Profile.Exec-before.Exec)
+		}
+		if err != nil {
+			c.ctx.report(Diagnostic{Pos: NoPos, Severity: SeverityError, Message: err.Error()}, fmt.Sprintf("Error: %v; skipping.\n", err))
 			continue
 		}
-		if printLLVMIR {
-			llvmIR.Dump()
+		if result != nil && !n.(*functionNode).discard {
+			fmt.Fprintln(opts.Output, formatResult(*result, opts))
 		}
+	}
+}
+
+// describe returns a short description of the top-level statement n,
+// for -time.
+func describe(n node) string {
+	switch n := n.(type) {
+	case *functionNode:
 		if isTopLevelExpr(n) {
-			returnval := execEngine.RunFunction(llvmIR, []llvm.GenericValue{})
-			fmt.Println(returnval.Float(llvm.DoubleType()))
+			return "expression"
+		}
+		return "def " + n.proto.(*fnPrototypeNode).name
+	case *fnPrototypeNode:
+		return "extern " + n.name
+	case *enumNode:
+		return "enum " + n.name
+	case *globalVarNode:
+		return "var " + n.vars[0].name
+	}
+	return "statement"
+}
+
+// writeLLVM writes the IR of the whole module to filename.
+func (ctx *genContext) writeLLVM(filename string) {
+	ctx.optimizeModule()
+	if err := ioutil.WriteFile(filename, []byte(ctx.module.String()), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// writeBitcode writes the whole module to filename as LLVM bitcode.
+func (ctx *genContext) writeBitcode(filename string) {
+	ctx.optimizeModule()
+	f, err := os.Create(filename)
+	if err == nil {
+		err = llvm.WriteBitcodeToFile(ctx.module, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// writeLLVMBoth writes the IR collected before and after optimization
+// to base.unopt.ll and base.opt.ll.
+func (ctx *genContext) writeLLVMBoth(base string) {
+	for name, ir := range map[string]*bytes.Buffer{
+		base + ".unopt.ll": ctx.unoptIR,
+		base + ".opt.ll":   ctx.optIR,
+	} {
+		if err := ioutil.WriteFile(name, ir.Bytes(), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// link reads every top-level statement from roots and declares all of
+// the functions they define, so that calls may precede definitions,
+// even across files. It returns the statements reordered so that
+// declarations come first, then definitions, each after the functions
+// it calls (where there is no cycle), followed by the top-level
+// expressions in their original order. A function defined more than
+// once is an error; only its first definition is kept.
+func (c *CodeGenContext) link(roots <-chan node) <-chan node {
+	var all, exprs []node
+	defs := map[string]*functionNode{}
+	for n := range roots {
+		all = append(all, n)
+		if f, ok := n.(*functionNode); ok && !isTopLevelExpr(f) {
+			proto := f.proto.(*fnPrototypeNode)
+			if _, ok := defs[proto.name]; ok {
+				c.ctx.errorCode(errRedefinition, proto.Pos, "redefinition of function: "+proto.name)
+				continue
+			}
+			defs[proto.name] = f
+			// declare the function ahead of its definition.
+			if proto.codegen(c.ctx).IsNil() {
+				fmt.Fprintf(os.Stderr, "Error: could not declare %s\n", proto.name)
+			}
+		}
+	}
+
+	// externs, enums and globals may be used by any definition.
+	ordered := make(chan node, len(all))
+	for _, n := range all {
+		if n.Kind() != nodeFunction {
+			ordered <- n
+		}
+	}
+
+	visited := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		f, ok := defs[name]
+		if !ok || visited[name] {
+			return
 		}
+		visited[name] = true
+		for _, callee := range callees(f.body) {
+			visit(callee)
+		}
+		ordered <- f
+	}
+
+	for _, n := range all {
+		switch {
+		case isTopLevelExpr(n):
+			exprs = append(exprs, n)
+		case n.Kind() == nodeFunction:
+			visit(n.(*functionNode).proto.(*fnPrototypeNode).name)
+		}
+	}
+	for _, n := range exprs {
+		ordered <- n
+	}
+	close(ordered)
+	return ordered
+}
+
+// callees returns the names of the functions called from n, including
+// user-defined operators.
+func callees(n node) []string {
+	var names []string
+	Walk(n, func(n node) bool {
+		switch n := n.(type) {
+		case *fnCallNode:
+			names = append(names, n.callee)
+		case *unaryNode:
+			names = append(names, "unary"+n.name)
+		case *binaryNode:
+			names = append(names, "binary"+n.op)
+		}
+		return true
+	})
+	return names
+}
+
+// Step JIT-compiles a single top-level statement and, if it is an
+// expression, executes it. The result is nil for definitions and
+// extern declarations. Expressions of constants alone, such as 3 * 4 + 1,
+// are evaluated directly; see constEval.
+func (c *CodeGenContext) Step(n node) (result *Result, err error) {
+	if f, ok := n.(*functionNode); ok && isTopLevelExpr(f) && !c.abandoned {
+		if v, ok := constEval(f.body, c.ctx.intWidth); ok {
+			return &Result{Float: v}, nil
+		}
+	}
+	llvmIR, err := c.compile(n)
+	if err != nil || !isTopLevelExpr(n) {
+		return nil, err
+	}
+	c.execClock.start()
+	defer c.execClock.stop()
+	if c.timeout <= 0 {
+		f := c.ctx.execEngine.RunFunction(llvmIR, []llvm.GenericValue{}).Float(c.ctx.context.DoubleType())
+		return c.result(n, f)
+	}
+
+	// the JIT'd code can't be preempted, so on timeout we leave it
+	// running in its goroutine and refuse to run anything else.
+	done := make(chan float64, 1)
+	go func() {
+		done <- c.ctx.execEngine.RunFunction(llvmIR, []llvm.GenericValue{}).Float(c.ctx.context.DoubleType())
+	}()
+	select {
+	case f := <-done:
+		return c.result(n, f)
+	case <-time.After(c.timeout):
+		c.abandoned = true
+		return nil, fmt.Errorf("timed out after %v", c.timeout)
+	}
+}
+
+// result returns the result f of running n, unless the stack guard
+// refused a call along the way, making it meaningless.
+func (c *CodeGenContext) result(n node, f float64) (*Result, error) {
+	if c.ctx.overflowed() {
+		return nil, fmt.Errorf("calls were nested more than %d deep, so the expression was abandoned; see -stack-guard", c.ctx.stackGuard)
+	}
+	return newResult(n, f), nil
+}
+
+// compile generates the code for a single top-level statement without
+// running it, returning the function or declaration generated.
+func (c *CodeGenContext) compile(n node) (llvm.Value, error) {
+	if c.abandoned {
+		return llvm.Value{}, errors.New("an earlier expression timed out and is still running")
+	}
+	var key [32]byte
+	if f, ok := n.(*functionNode); ok && c.memo != nil {
+		if !isTopLevelExpr(f) {
+			c.forget(f.proto.(*fnPrototypeNode).name)
+		} else if key = memoKey(f); !c.memo[key].fn.IsNil() {
+			f.intResult = c.memo[key].intResult
+			return c.memo[key].fn, nil
+		}
+	}
+	if c.peephole {
+		n = Peephole(n, c.unsafePeephole)
+	}
+	c.codegenClock.start()
+	llvmIR := n.codegen(c.ctx)
+	if isTopLevelExpr(n) {
+		c.ctx.optimizeModule()
+	}
+	c.codegenClock.stop()
+	if llvmIR.IsNil() {
+		return llvm.Value{}, errors.New("codegen failed")
+	}
+	if c.memo != nil && isTopLevelExpr(n) {
+		f := n.(*functionNode)
+		c.memo[key] = memoEntry{llvmIR, f.intResult, callees(f)}
+	}
+	if proto, ok := n.(*fnPrototypeNode); ok {
+		if err := c.ctx.bindExtern(proto, llvmIR); err != nil {
+			return llvm.Value{}, err
+		}
+	}
+	if c.printLLVMIR {
+		llvmIR.Dump()
+	}
+	return llvmIR, nil
+}
+
+// newResult returns the result f of running the top-level expression n.
+// Integer results are passed back as the bits of f.
+func newResult(n node, f float64) *Result {
+	if n.(*functionNode).intResult {
+		return &Result{Int: int64(math.Float64bits(f)), IsInt: true}
+	}
+	return &Result{Float: f}
+}
+
+// Eval compiles and runs a single expression, lexed and parsed with
+// e's options, returning its value. Functions already defined in e may
+// be called from expr, but definitions and extern declarations are not
+// allowed in it. As with Run, Diagnostics returns only the errors
+// reported for expr.
+func (e *Engine) Eval(expr string) (float64, error) {
+	var nodes []node
+	if err := e.each(expr, func(n node) { nodes = append(nodes, n) }); err != nil {
+		return 0, err
+	}
+	switch {
+	case len(nodes) == 0:
+		return 0, errors.New("invalid expression")
+	case len(nodes) > 1:
+		return 0, errors.New("expected a single expression")
+	case !isTopLevelExpr(nodes[0]):
+		return 0, errors.New("only expressions may be evaluated")
+	}
+
+	result, err := e.Step(nodes[0])
+	if err != nil {
+		return 0, err
+	}
+	return result.Float64(), nil
+}
+
+// IsDefined reports whether name refers to a function that has been
+// defined or declared extern, or to a global variable.
+func (c *CodeGenContext) IsDefined(name string) bool {
+	if _, ok := c.ctx.globalVals[name]; ok {
+		return true
+	}
+	return !c.ctx.module.NamedFunction(name).IsNil()
+}
+
+// IRForFunction returns the textual LLVM IR of the named function,
+// which must have been defined or declared extern.
+func (c *CodeGenContext) IRForFunction(name string) (string, error) {
+	f := c.ctx.module.NamedFunction(name)
+	if f.IsNil() {
+		return "", fmt.Errorf("unknown function %q", name)
 	}
+	return f.String(), nil
 }
 
 // isTopLevelExpr determines if the node is a top level expression.
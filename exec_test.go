@@ -0,0 +1,140 @@
+package kaleidoscope
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalAfterDef(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	if err := e.Compile("def double(x) 2 * x"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.Eval("double(21)"); err != nil || got != 42 {
+		t.Errorf("double(21) gave %v, %v, want 42", got, err)
+	}
+	if _, err := e.Eval("def triple(x) 3 * x"); err == nil {
+		t.Errorf("a definition was evaluated")
+	}
+}
+
+func TestEvalUsesOptions(t *testing.T) {
+	e := newTestEngine(t, Options{RequireSemicolons: true})
+	if _, err := e.Eval("1 + 2"); err == nil {
+		t.Errorf("an expression without a semicolon was accepted")
+	}
+	if got, err := e.Eval("1 + 2;"); err != nil || got != 3 {
+		t.Errorf("1 + 2; gave %v, %v, want 3", got, err)
+	}
+	if ds := e.Diagnostics(); len(ds) != 0 {
+		t.Errorf("the diagnostics of the earlier call were kept: %v", ds)
+	}
+}
+
+// TestIRForFunction checks that the IR of a single function names it
+// and returns.
+func TestIRForFunction(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	if err := e.Compile("def inc(x) x + 1"); err != nil {
+		t.Fatal(err)
+	}
+	ir, err := e.IRForFunction("inc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ir, "@inc(") || !strings.Contains(ir, "ret ") {
+		t.Errorf("IR doesn't name the function and return:\n%s", ir)
+	}
+}
+
+// TestTimeout checks that an expression which never finishes is
+// reported as timed out.
+func TestTimeout(t *testing.T) {
+	e := newTestEngine(t, Options{Timeout: 50 * time.Millisecond})
+	_, err := e.Run("def spin(x) for i = 0, 1 in x; spin(0)")
+	if err == nil || !strings.Contains(err.Error(), "timed out after") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+// TestLLVMBoth checks that optimizing a function whose local is
+// constant changes the IR written by EmitLLVMBoth.
+func TestLLVMBoth(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "both")
+	e := newTestEngine(t, Options{OptLevel: 1, EmitLLVMBoth: base})
+	interpret(t, e, "both.k", "def both(x) var y = 2 in x * y")
+	unopt, opt := readFile(t, base+".unopt.ll"), readFile(t, base+".opt.ll")
+	if opt == "" || unopt == opt {
+		t.Errorf("optimized IR is empty or unchanged:\n%s", opt)
+	}
+}
+
+// TestEmitLLVM checks that the IR written at the end of a run holds
+// every function defined, not just the last.
+func TestEmitLLVM(t *testing.T) {
+	ll := filepath.Join(t.TempDir(), "out.ll")
+	e := newTestEngine(t, Options{EmitLLVM: ll})
+	interpret(t, e, "emit.k", "def first(x) x + 1\ndef second(x) first(x) * 2\nsecond(1)\n")
+	ir := readFile(t, ll)
+	for _, name := range []string{"@first(", "@second("} {
+		if !strings.Contains(ir, name) {
+			t.Errorf("no %s in:\n%s", name, ir)
+		}
+	}
+}
+
+// captureStderr calls f with os.Stderr redirected to a pipe, which f is
+// also given, and returns what was written to it.
+func captureStderr(t *testing.T, f func(w io.Writer)) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		done <- string(b)
+	}()
+	stderr := os.Stderr
+	os.Stderr = w
+	f(w)
+	os.Stderr = stderr
+	w.Close()
+	return <-done
+}
+
+// TestSerial checks that with Serial, an error at the end of the input
+// is reported before the statements before it run.
+func TestSerial(t *testing.T) {
+	out := captureStderr(t, func(w io.Writer) {
+		e, err := NewEngine(Options{Serial: true, Output: w})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Interpret(Input{"serial.k", strings.NewReader("1\n2\n)\n")})
+	})
+	errAt, resultAt := strings.Index(out, "unexpected right paren"), strings.Index(out, "\n1\n2\n")
+	if errAt < 0 || resultAt < 0 || errAt > resultAt {
+		t.Errorf("want the error before the results in:\n%s", out)
+	}
+}
+
+// TestTime checks that with Time, the optimizer's setup and each
+// statement are timed.
+func TestTime(t *testing.T) {
+	out := captureStderr(t, func(io.Writer) {
+		e := newTestEngine(t, Options{Time: true})
+		interpret(t, e, "time.k", "def timed(x) x\ntimed(1)\n")
+	})
+	for _, want := range []string{"time: optimize setup ", "time: def timed: codegen ", "time: expression: codegen "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in:\n%s", want, out)
+		}
+	}
+}
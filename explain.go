@@ -0,0 +1,75 @@
+package kaleidoscope
+
+// Diagnostic codes identify classes of errors so that their longer
+// explanations can be looked up with -explain.
+const (
+	errUnknownVariable = "E001"
+	errUnknownFunction = "E002"
+	errArgCount        = "E003"
+	errRedefinition    = "E004"
+)
+
+// explanations maps diagnostic codes to a description of the problem
+// and an example of how to fix it.
+var explanations = map[string]string{
+	errUnknownVariable: `A variable was used that isn't in scope.
+
+Variables come into scope as function parameters, 'for' loop counters
+and 'var ... in' bindings. They are only visible in the function or
+expression that binds them. Global variables, declared by a top-level
+'var' without 'in', are visible to everything compiled after them.
+
+Erroneous code example:
+
+    def f(a) a + b
+
+Bind the name before using it, e.g. by making it a parameter:
+
+    def f(a b) a + b
+`,
+	errUnknownFunction: `A function was called that has not been defined or declared.
+
+Functions must be defined with 'def' or declared with 'extern' before
+the statement that calls them is compiled.
+
+Erroneous code example:
+
+    cos(0)
+
+Declare the function first:
+
+    extern cos(x)
+    cos(0)
+`,
+	errArgCount: `A function was called with the wrong number of arguments.
+
+Erroneous code example:
+
+    def add(a b) a + b
+    add(1)
+
+Pass exactly as many arguments as the prototype has parameters:
+
+    add(1, 2)
+`,
+	errRedefinition: `A function with a body, an enum member or a global variable was
+defined a second time. Enum members and global variables also may not
+share names.
+
+Erroneous code examples:
+
+    def f(x) x + 1
+    def f(x) x + 2
+
+    enum Color { Red, Green }
+    enum Light { Red, Amber, Green }
+
+Give the second definition a different name.
+`,
+}
+
+// Explain returns the long explanation for the diagnostic code.
+func Explain(code string) (string, bool) {
+	e, ok := explanations[code]
+	return e, ok
+}
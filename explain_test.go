@@ -0,0 +1,16 @@
+package kaleidoscope
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	text, ok := Explain(errUnknownVariable)
+	if !ok || !strings.HasPrefix(text, "A variable was used that isn't in scope.") {
+		t.Errorf("wrong explanation of %s: %q", errUnknownVariable, text)
+	}
+	if _, ok := Explain("E999"); ok {
+		t.Errorf("E999 has an explanation")
+	}
+}
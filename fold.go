@@ -0,0 +1,176 @@
+package kaleidoscope
+
+import "math"
+
+// constFold evaluates the built-in arithmetic or comparison n at compile
+// time if its operands are number or integer literals, or expressions
+// (including negations) that fold to them. It returns a literal of the
+// result, a boolean for comparisons, or nil if n can't be folded.
+// Division by zero is never folded, leaving it to run time. Integers
+// are width bits wide, and wrap around as they would at run time.
+//
+// Strings joined by + are folded too, into a single string literal, so
+// that they become one global.
+func constFold(n *binaryNode, width int) node {
+	if n.op == "+" {
+		if l, ok := stringConst(n.left, width); ok {
+			if r, ok := stringConst(n.right, width); ok {
+				return &stringNode{nodeString, n.Pos, l + r}
+			}
+		}
+	}
+	switch l := literal(n.left, width).(type) {
+	case *numberNode:
+		if r, ok := literal(n.right, width).(*numberNode); ok {
+			return foldFloat(n, l.val, r.val)
+		}
+	case *integerNode:
+		if r, ok := literal(n.right, width).(*integerNode); ok {
+			return foldInt(n, l.val, r.val, width)
+		}
+	}
+	return nil
+}
+
+// literal returns n if it's a number, integer or boolean literal, or
+// the literal it folds to, with integers width bits wide, if it's
+// foldable; otherwise it returns nil.
+func literal(n node, width int) node {
+	switch n := n.(type) {
+	case *numberNode, *integerNode, *boolNode:
+		return n
+	case *unaryNode:
+		if n.name != "-" {
+			return nil
+		}
+		switch v := literal(n.operand, width).(type) {
+		case *numberNode:
+			return &numberNode{nodeNumber, n.Pos, -v.val}
+		case *integerNode:
+			return &integerNode{nodeInteger, n.Pos, wrap(-v.val, width)}
+		}
+	case *binaryNode:
+		if f := constFold(n, width); f != nil && f.Kind() != nodeString {
+			return f
+		}
+	}
+	return nil
+}
+
+// stringConst returns the value of n if it's a string literal or a
+// concatenation of them.
+func stringConst(n node, width int) (string, bool) {
+	switch n := n.(type) {
+	case *stringNode:
+		return n.val, true
+	case *binaryNode:
+		if s, ok := constFold(n, width).(*stringNode); ok {
+			return s.val, true
+		}
+	}
+	return "", false
+}
+
+// constEval returns the value of the expression n, and true, if it's
+// made only of literals and the built-in operators constFold handles,
+// so that it can be computed without generating any code. Integer
+// expressions aren't evaluated, as their results are passed back
+// differently; see newResult. Integers compared are width bits wide.
+func constEval(n node, width int) (float64, bool) {
+	switch n := literal(n, width).(type) {
+	case *numberNode:
+		return n.val, true
+	case *boolNode:
+		if n.val {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// isZeroLiteral reports whether n is, or folds to, a zero literal,
+// with integers width bits wide.
+func isZeroLiteral(n node, width int) bool {
+	switch n := literal(n, width).(type) {
+	case *numberNode:
+		return n.val == 0
+	case *integerNode:
+		return n.val == 0
+	}
+	return false
+}
+
+func foldFloat(n *binaryNode, l, r float64) node {
+	num := func(v float64) node { return &numberNode{nodeNumber, n.Pos, v} }
+	boolean := func(b bool) node { return &boolNode{nodeBool, n.Pos, b} }
+	switch n.op {
+	case "+":
+		return num(l + r)
+	case "-":
+		return num(l - r)
+	case "*":
+		return num(l * r)
+	case "/":
+		if r == 0 {
+			return nil
+		}
+		return num(l / r)
+	case "^":
+		return num(math.Pow(l, r))
+	// the comparisons are ordered: false if either operand is NaN.
+	case "<":
+		return boolean(l < r)
+	case ">":
+		return boolean(l > r)
+	case "<=":
+		return boolean(l <= r)
+	case ">=":
+		return boolean(l >= r)
+	case "==":
+		return boolean(l == r)
+	case "!=":
+		return boolean(l < r || l > r)
+	}
+	return nil
+}
+
+func foldInt(n *binaryNode, l, r int64, width int) node {
+	integer := func(v int64) node { return &integerNode{nodeInteger, n.Pos, wrap(v, width)} }
+	boolean := func(b bool) node { return &boolNode{nodeBool, n.Pos, b} }
+	switch n.op {
+	case "+":
+		return integer(l + r)
+	case "-":
+		return integer(l - r)
+	case "*":
+		return integer(l * r)
+	case "/":
+		if r == 0 || l == -1<<uint(width-1) && r == -1 {
+			return nil // undefined; leave it for run time
+		}
+		return integer(l / r)
+	case "^": // a double, as at run time
+		return &numberNode{nodeNumber, n.Pos, math.Pow(float64(l), float64(r))}
+	case "<":
+		return boolean(l < r)
+	case ">":
+		return boolean(l > r)
+	case "<=":
+		return boolean(l <= r)
+	case ">=":
+		return boolean(l >= r)
+	case "==":
+		return boolean(l == r)
+	case "!=":
+		return boolean(l != r)
+	}
+	return nil
+}
+
+// wrap returns v truncated to a signed integer width bits wide, as
+// integer arithmetic wraps around at run time.
+func wrap(v int64, width int) int64 {
+	shift := 64 - uint(width)
+	return v << shift >> shift
+}
@@ -0,0 +1,31 @@
+package kaleidoscope
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestStringConcat checks that "foo" + "bar" is compiled to a single
+// global string.
+func TestStringConcat(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	if err := e.Compile(`def concat(): string "foo" + "bar"`); err != nil {
+		t.Fatal(err)
+	}
+	ir := e.ctx.module.String()
+	if strings.Count(ir, `c"foobar\00"`) != 1 || strings.Contains(ir, `c"foo\00"`) {
+		t.Errorf("want one global \"foobar\" in:\n%s", ir)
+	}
+}
+
+// TestIntWidth checks that with 8-bit ints, constant expressions wrap
+// around as they would at run time, and literals must fit.
+func TestIntWidth(t *testing.T) {
+	e := newTestEngine(t, Options{IntWidth: 8})
+	if got, err := e.Run("100i + 100i > 0i"); err != nil || got != 0 {
+		t.Errorf("100i + 100i > 0i gave %v, %v, want 0", got, err)
+	}
+	if _, err := e.Run("200i"); err == nil {
+		t.Errorf("200i was accepted as an 8-bit int")
+	}
+}
@@ -0,0 +1,322 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// formatNumber formats f for output as fmt.Println would, but with the
+// decimal and digit grouping separators given in opts.
+// e.g. 1234.56 with DecimalSep "," and GroupSep "." gives "1.234,56"
+// Grouped numbers are never written with an exponent, since the digits
+// of one can't be grouped.
+func formatNumber(f float64, opts Options) string {
+	format := byte('g')
+	if opts.GroupSep != "" {
+		format = 'f'
+	}
+	return localize(strconv.FormatFloat(f, format, -1, 64), opts)
+}
+
+// formatResult formats the result of a top-level expression for output.
+func formatResult(r Result, opts Options) string {
+	if r.IsInt {
+		return localize(strconv.FormatInt(r.Int, 10), opts)
+	}
+	return formatNumber(r.Float, opts)
+}
+
+// localize replaces the separators in s, a formatted number, with those
+// given in opts.
+func localize(s string, opts Options) string {
+	if (opts.DecimalSep == "" || opts.DecimalSep == ".") && opts.GroupSep == "" {
+		return s
+	}
+
+	// split into sign, integer, fraction and exponent.
+	var sign, exp string
+	if s[0] == '-' || s[0] == '+' {
+		sign, s = s[:1], s[1:]
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		s, exp = s[:i], s[i:]
+	}
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+
+	// NaN and Inf have no digits to group.
+	if intPart == "NaN" || intPart == "Inf" {
+		return sign + intPart
+	}
+
+	if opts.GroupSep != "" {
+		var b strings.Builder
+		for i, r := range intPart {
+			if i > 0 && (len(intPart)-i)%3 == 0 {
+				b.WriteString(opts.GroupSep)
+			}
+			b.WriteRune(r)
+		}
+		intPart = b.String()
+	}
+
+	if frac != "" {
+		dec := opts.DecimalSep
+		if dec == "" {
+			dec = "."
+		}
+		intPart += dec + frac
+	}
+	return sign + intPart + exp
+}
+
+// Format returns canonical source for n, a parsed top-level statement,
+// with only the parentheses that the built-in operator precedences
+// call for. As Format doesn't know the precedences of user operators,
+// their operands are always parenthesized; Engine.Format knows them.
+// Comments and 'extern type' declarations leave nothing in the tree,
+// so they're lost. Parsing the result gives the same tree as n.
+func Format(n node) string {
+	return formatter{builtinPrecedence}.stmt(n)
+}
+
+// Format reformats src, a whole program, a statement per line, using
+// the operators defined so far in e and in src itself.
+func (e *Engine) Format(src string) (string, error) {
+	var nodes []node
+	if err := e.each(src, func(n node) { nodes = append(nodes, n) }); err != nil {
+		return "", err
+	}
+	return formatProgram(nodes, e.Precedences()), nil
+}
+
+// formatProgram formats the statements in nodes, a statement per line,
+// given the precedences of the binary operators they use. A statement
+// that begins with an operator would continue the line before it, so
+// that line ends in a ';'.
+func formatProgram(nodes []node, prec map[string]int) string {
+	f := formatter{prec}
+	var b strings.Builder
+	for i, n := range nodes {
+		s := f.stmt(n)
+		if i > 0 {
+			if r := []rune(s)[0]; !startsOperand(r) && r != '"' && r != '\\' {
+				b.WriteString(";")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(s)
+	}
+	if len(nodes) > 0 {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// formatter formats trees given the precedences of binary operators.
+type formatter struct {
+	prec map[string]int
+}
+
+// tightest is the precedence of primary and unary expressions, which
+// bind more tightly than any binary operator. Expressions such as if
+// and for, which extend as far to the right as they can, have the
+// precedence 0, so they're parenthesized wherever they're an operand.
+const tightest = math.MaxInt32
+
+func (f formatter) stmt(n node) string {
+	switch n := n.(type) {
+	case *functionNode:
+		if !isTopLevelExpr(n) {
+			return "def " + f.proto(n.proto.(*fnPrototypeNode)) + " " + f.expr(n.body, 0)
+		}
+		min := 0
+		if n.body.Kind() == nodeNestedFunction {
+			min = 1 // or it would be a top-level definition
+		}
+		if n.discard {
+			return "discard " + f.expr(n.body, min)
+		}
+		return f.expr(n.body, min)
+	case *fnPrototypeNode:
+		return "extern " + f.proto(n)
+	case *enumNode:
+		members := []string{}
+		next := 0.0
+		for _, m := range n.members {
+			if m.value == next {
+				members = append(members, m.name)
+			} else {
+				members = append(members, m.name+" = "+formatDouble(m.value))
+			}
+			next = m.value + 1
+		}
+		return "enum " + n.name + " { " + strings.Join(members, ", ") + " }"
+	case *globalVarNode:
+		return "var " + f.decls(n.vars)
+	}
+	return f.expr(n, 0)
+}
+
+// expr formats n, parenthesized if its precedence is less than min.
+func (f formatter) expr(n node, min int) string {
+	s, prec := f.format(n)
+	if prec < min {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// format formats n, returning the precedence of the result.
+func (f formatter) format(n node) (string, int) {
+	switch n := n.(type) {
+	case *numberNode:
+		return formatDouble(n.val), tightest
+	case *integerNode:
+		if n.val < 0 { // only hex literals can be negative
+			return fmt.Sprintf("%#x", uint64(n.val)), tightest
+		}
+		return strconv.FormatInt(n.val, 10) + "i", tightest
+	case *rationalNode:
+		return fmt.Sprintf("%d/%dr", n.num, n.den), tightest
+	case *stringNode:
+		return quote(n.val), tightest
+	case *boolNode:
+		return strconv.FormatBool(n.val), tightest
+	case *variableNode:
+		return n.name, tightest
+	case *indexNode:
+		return n.name + "[" + f.expr(n.index, 0) + "]", tightest
+	case *incDecNode:
+		if n.prefix {
+			return n.op + n.name, tightest
+		}
+		return n.name + n.op, tightest
+	case *fnCallNode:
+		args := []string{}
+		for _, a := range n.args {
+			args = append(args, f.expr(a, 0))
+		}
+		return n.callee + "(" + strings.Join(args, ", ") + ")", tightest
+	case *blockNode:
+		exprs := []string{}
+		for _, e := range n.exprs {
+			exprs = append(exprs, f.expr(e, 0))
+		}
+		return "{ " + strings.Join(exprs, "; ") + " }", tightest
+	case *unaryNode:
+		operand := f.expr(n.operand, tightest)
+		if r := []rune(operand)[0]; !startsOperand(r) {
+			operand = " " + operand // so that - -x doesn't become --x
+		}
+		return n.name + operand, tightest
+	case *binaryNode:
+		prec, ok := f.prec[n.op]
+		if !ok {
+			// parenthesize both operands, and this wherever it's one.
+			return f.expr(n.left, tightest) + " " + n.op + " " + f.expr(n.right, tightest), 0
+		}
+		left, right := prec, prec+1
+		if rightAssociative[n.op] {
+			left, right = prec+1, prec
+		}
+		return f.expr(n.left, left) + " " + n.op + " " + f.expr(n.right, right), prec
+	case *ifNode:
+		return "if " + f.expr(n.ifN, 0) + " then " + f.expr(n.thenN, 0) + " else " + f.expr(n.elseN, 0), 0
+	case *forNode:
+		s := "for " + n.counter + " = " + f.expr(n.start, 0) + ", " + f.expr(n.test, 0)
+		if n.step != nil {
+			s += ", " + f.expr(n.step, 0)
+		}
+		if n.result == nil {
+			return s + " in " + f.expr(n.body, 0), 0
+		}
+		// a loop ending the body would take the 'yielding' for its own.
+		return s + " in " + f.expr(n.body, 1) + " yielding " + f.expr(n.result, 0), 0
+	case *whileNode:
+		return "while " + f.expr(n.cond, 0) + " in " + f.expr(n.body, 0), 0
+	case *doWhileNode:
+		return "do " + f.expr(n.body, 0) + " while " + f.expr(n.cond, 0), 0
+	case *variableExprNode:
+		if n.body == nil {
+			return "var " + f.decls(n.vars), 0
+		}
+		return "var " + f.decls(n.vars) + " in " + f.expr(n.body, 0), 0
+	case *nestedFnNode:
+		fn := n.fn.(*functionNode)
+		return "def " + f.proto(fn.proto.(*fnPrototypeNode)) + " " + f.expr(fn.body, 0) + " in " + f.expr(n.body, 0), 0
+	case *lambdaNode:
+		fn := n.fn.(*functionNode)
+		return "\\(" + strings.Join(fn.proto.(*fnPrototypeNode).args, ", ") + ") " + f.expr(fn.body, 0), 0
+	case *returnNode:
+		return "return " + f.expr(n.value, 0), 0
+	case *breakNode:
+		return "break", tightest
+	case *continueNode:
+		return "continue", tightest
+	}
+	panic(fmt.Sprintf("Format: unexpected %T", n)) // every expression is handled above
+}
+
+// proto formats a prototype, without 'def' or 'extern'.
+func (f formatter) proto(p *fnPrototypeNode) string {
+	var b strings.Builder
+	switch {
+	case p.isOperator && strings.HasPrefix(p.name, "unary"):
+		b.WriteString("unary " + strings.TrimPrefix(p.name, "unary") + " ")
+	case p.isOperator:
+		fmt.Fprintf(&b, "binary %s %d ", strings.TrimPrefix(p.name, "binary"), p.precedence)
+	default:
+		b.WriteString(p.name)
+	}
+	args := []string{}
+	for i, a := range p.args {
+		if p.argTypes[i] != "" {
+			a += ": " + p.argTypes[i]
+		}
+		args = append(args, a)
+	}
+	b.WriteString("(" + strings.Join(args, ", ") + ")")
+	if p.retType != "" {
+		b.WriteString(": " + p.retType)
+	}
+	return b.String()
+}
+
+// decls formats the variables declared by 'var', without the keyword.
+func (f formatter) decls(vars []struct {
+	name string
+	node node
+	size int
+}) string {
+	decls := []string{}
+	for _, v := range vars {
+		d := v.name
+		if v.size > 0 {
+			d += "[" + strconv.Itoa(v.size) + "]"
+		}
+		if v.node != nil {
+			d += " = " + f.expr(v.node, 0)
+		}
+		decls = append(decls, d)
+	}
+	return strings.Join(decls, ", ")
+}
+
+// startsOperand reports whether r can begin a name, literal or
+// parenthesized expression, and so can't join an operator before it.
+func startsOperand(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '(' || r == '{' || r == '.'
+}
+
+// quote returns s as a string literal, escaping only what the lexer
+// accepts escaped.
+func quote(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t")
+	return "\"" + r.Replace(s) + "\""
+}
@@ -0,0 +1,12 @@
+package kaleidoscope
+
+import "testing"
+
+// TestGrouping checks that numbers too large for %g without an
+// exponent are still grouped.
+func TestGrouping(t *testing.T) {
+	got := formatNumber(1e21, Options{GroupSep: ","})
+	if want := "1,000,000,000,000,000,000,000"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+module github.com/ajsnow/kaleidoscope
+
+go 1.21
+
+require (
+	github.com/ajsnow/llvm v0.0.0-00010101000000-000000000000
+	github.com/davecgh/go-spew v1.1.1
+	github.com/peterh/liner v1.2.2
+	golang.org/x/text v0.17.0
+)
+
+// The LLVM bindings use cgo and must be built against the installed
+// LLVM, so they're used from a checkout next to this one; see README.md.
+replace github.com/ajsnow/llvm => ../llvm
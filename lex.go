@@ -1,21 +1,29 @@
-package main
+package kaleidoscope
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/davecgh/go-spew/spew"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
 )
 
 // token represents the basic lexicographical units of the language.
 type token struct {
-	kind tokenType // The kind of token with which we're dealing.
-	pos  Pos       // The byte offset of the beginning of the token with respect to the beginning of the input.
-	val  string    // The token's value. Error message for lexError; otherwise, the token's constituent text.
+	kind   tokenType // The kind of token with which we're dealing.
+	pos    Pos       // The byte offset of the beginning of the token with respect to the beginning of its line.
+	val    string    // The token's value. Error message for lexError; otherwise, the token's constituent text.
+	line   int       // The line on which the token begins, starting from 1.
+	offset Pos       // The byte offset of the beginning of the token with respect to the beginning of the input.
+	src    string    // The text of the line on which the token begins, for error messages.
 }
 
 // Defining the String function satisfies the Stinger interface.
@@ -54,9 +62,20 @@ const (
 	tokComma
 	tokLeftParen
 	tokRightParen
+	tokLeftBrace
+	tokRightBrace
+	tokLeftBracket
+	tokRightBracket
+	tokColon
+	tokQuestion
+	tokLambda
 
 	// literals
 	tokNumber
+	tokInteger
+	tokRational
+	tokString
+	tokChar
 
 	// identifiers
 	tokIdentifier
@@ -69,10 +88,21 @@ const (
 	tokThen
 	tokElse
 	tokFor
+	tokWhile
+	tokDo
 	tokIn
+	tokYielding
 	tokBinary
 	tokUnary
 	tokVariable
+	tokType
+	tokDiscard
+	tokEnum
+	tokReturn
+	tokTrue
+	tokFalse
+	tokBreak
+	tokContinue
 
 	// operators
 	tokUserUnaryOp // additionally used to delineate operators
@@ -82,21 +112,124 @@ const (
 	tokMinus
 	tokStar
 	tokSlash
+	tokCaret
 	tokLessThan
+	tokGreaterThan
+	tokLessEqual
+	tokGreaterEqual
+	tokEqualEqual
+	tokNotEqual
+	tokAndAnd
+	tokOrOr
+	tokPlusEqual
+	tokMinusEqual
+	tokStarEqual
+	tokSlashEqual
+	tokIncrement
+	tokDecrement
 )
 
+// tokenNames maps tokenTypes to human readable names.
+var tokenNames = map[tokenType]string{
+	tokEndOfTokens:  "EOF",
+	tokError:        "Error",
+	tokNewFile:      "NewFile",
+	tokComment:      "Comment",
+	tokSpace:        "Space",
+	tokSemicolon:    "Semicolon",
+	tokComma:        "Comma",
+	tokLeftParen:    "LeftParen",
+	tokRightParen:   "RightParen",
+	tokLeftBrace:    "LeftBrace",
+	tokRightBrace:   "RightBrace",
+	tokLeftBracket:  "LeftBracket",
+	tokRightBracket: "RightBracket",
+	tokColon:        "Colon",
+	tokQuestion:     "Question",
+	tokLambda:       "Lambda",
+	tokNumber:       "Number",
+	tokInteger:      "Integer",
+	tokRational:     "Rational",
+	tokString:       "String",
+	tokChar:         "Char",
+	tokIdentifier:   "Identifier",
+	tokDefine:       "Define",
+	tokExtern:       "Extern",
+	tokIf:           "If",
+	tokThen:         "Then",
+	tokElse:         "Else",
+	tokFor:          "For",
+	tokWhile:        "While",
+	tokDo:           "Do",
+	tokIn:           "In",
+	tokYielding:     "Yielding",
+	tokBinary:       "Binary",
+	tokUnary:        "Unary",
+	tokVariable:     "Variable",
+	tokType:         "Type",
+	tokDiscard:      "Discard",
+	tokEnum:         "Enum",
+	tokReturn:       "Return",
+	tokTrue:         "True",
+	tokFalse:        "False",
+	tokBreak:        "Break",
+	tokContinue:     "Continue",
+	tokUserUnaryOp:  "UserUnaryOp",
+	tokUserBinaryOp: "UserBinaryOp",
+	tokEqual:        "Equal",
+	tokPlus:         "Plus",
+	tokMinus:        "Minus",
+	tokStar:         "Star",
+	tokSlash:        "Slash",
+	tokCaret:        "Caret",
+	tokLessThan:     "LessThan",
+	tokGreaterThan:  "GreaterThan",
+	tokLessEqual:    "LessEqual",
+	tokGreaterEqual: "GreaterEqual",
+	tokEqualEqual:   "EqualEqual",
+	tokNotEqual:     "NotEqual",
+	tokAndAnd:       "AndAnd",
+	tokOrOr:         "OrOr",
+	tokPlusEqual:    "PlusEqual",
+	tokMinusEqual:   "MinusEqual",
+	tokStarEqual:    "StarEqual",
+	tokSlashEqual:   "SlashEqual",
+	tokIncrement:    "Increment",
+	tokDecrement:    "Decrement",
+}
+
+// String returns the name of the tokenType.
+func (tt tokenType) String() string {
+	if name, ok := tokenNames[tt]; ok {
+		return name
+	}
+	return fmt.Sprintf("tokenType(%d)", int(tt))
+}
+
 // key maps keywords strings to their tokenType.
 var key = map[string]tokenType{
-	"def":    tokDefine,
-	"extern": tokExtern,
-	"if":     tokIf,
-	"then":   tokThen,
-	"else":   tokElse,
-	"for":    tokFor,
-	"in":     tokIn,
-	"binary": tokBinary,
-	"unary":  tokUnary,
-	"var":    tokVariable,
+	"def":      tokDefine,
+	"extern":   tokExtern,
+	"if":       tokIf,
+	"then":     tokThen,
+	"else":     tokElse,
+	"for":      tokFor,
+	"while":    tokWhile,
+	"do":       tokDo,
+	"in":       tokIn,
+	"yielding": tokYielding,
+	"binary":   tokBinary,
+	"unary":    tokUnary,
+	"var":      tokVariable,
+	"let":      tokVariable, // for those used to ML-family languages
+	"type":     tokType,
+	"discard":  tokDiscard,
+	"enum":     tokEnum,
+	"return":   tokReturn,
+	"true":     tokTrue,
+	"false":    tokFalse,
+	"break":    tokBreak,
+	"continue": tokContinue,
 }
 
 // op maps built-in operators to tokenTypes
@@ -107,7 +240,26 @@ var op = map[rune]tokenType{
 	'-': tokMinus,
 	'*': tokStar,
 	'/': tokSlash,
+	'^': tokCaret,
 	'<': tokLessThan,
+	'>': tokGreaterThan,
+}
+
+// multiRuneOp maps built-in operators of more than one rune to
+// tokenTypes. They're matched before single-rune and user operators.
+var multiRuneOp = map[string]tokenType{
+	"<=": tokLessEqual,
+	">=": tokGreaterEqual,
+	"==": tokEqualEqual,
+	"!=": tokNotEqual,
+	"&&": tokAndAnd,
+	"||": tokOrOr,
+	"+=": tokPlusEqual,
+	"-=": tokMinusEqual,
+	"*=": tokStarEqual,
+	"/=": tokSlashEqual,
+	"++": tokIncrement,
+	"--": tokDecrement,
 }
 
 // userOpType differentiates a user-defined unary, binary or not found operator.
@@ -122,9 +274,15 @@ const (
 // stateFn represents the state of the scanner as a function that returns the next state.
 type stateFn func(*lexer) stateFn
 
+// input is a named source of text to be lexed.
+type input struct {
+	name string
+	r    io.Reader
+}
+
 // lexer holds the state of the scanner.
 type lexer struct {
-	files         chan *os.File       // files to be lexed
+	files         chan input          // files to be lexed
 	scanner       *bufio.Scanner      // scanner is a buffered interface to the current file
 	name          string              // name of current input file; used in error reports
 	line          string              // current line being scanned
@@ -133,18 +291,28 @@ type lexer struct {
 	start         Pos                 // beginning position of the current token
 	width         Pos                 // width of last rune read from input
 	lineCount     int                 // number of lines seen in the current file
+	lineStart     Pos                 // offset of the current line from the beginning of the file
+	lineLen       Pos                 // length of the current line in the file, including its "\n" or "\r\n"
+	maxLineLength int                 // longest line the scanner will buffer; 0 for bufio's default
+	encoding      string              // character encoding of the input; "" for UTF-8
 	parenDepth    int                 // nested layers of paren expressions
 	tokens        chan token          // channel of lexed items
 	userOperators map[rune]userOpType // userOperators maps user defined operators to number of operands
+	clock         stopwatch           // time spent lexing, for profiling
 }
 
 // Lex creates and runs a new lexer.
-func Lex() *lexer {
+func Lex(opts Options) *lexer {
 	l := &lexer{
-		files:         make(chan *os.File, 10),
+		files:         make(chan input, 10),
 		tokens:        make(chan token, 10),
+		maxLineLength: opts.MaxLineLength,
+		encoding:      opts.Encoding,
 		userOperators: map[rune]userOpType{},
 	}
+	if opts.Profile != nil {
+		l.clock.total = &opts.Profile.Lex
+	}
 	go l.run()
 	return l
 }
@@ -152,9 +320,16 @@ func Lex() *lexer {
 // Add adds the given file to the lexer's file queue.
 // N.B. Add can block (waiting on the lex's files chan to clear),
 // so it should be called in a different goroutine than the ultimate
-// consumer of the compiler's pipeline, e.g. Exec.
+// consumer of the compiler's pipeline, e.g. Engine.Interpret.
 func (l *lexer) Add(f *os.File) {
-	l.files <- f
+	l.AddReader(f.Name(), f)
+}
+
+// AddReader adds the given reader to the lexer's file queue under
+// name. If r is also an io.Closer, it is closed once it has been lexed.
+// Like Add, AddReader can block.
+func (l *lexer) AddReader(name string, r io.Reader) {
+	l.files <- input{name, r}
 }
 
 // Done signals that the user is finished Add()ing files
@@ -170,9 +345,68 @@ func (l *lexer) Tokens() <-chan token {
 	return l.tokens
 }
 
+// Next returns the next token, waiting for it to be lexed, or false
+// once all the input has been lexed. It's for use outside the package,
+// e.g. by syntax highlighters; don't mix it with reading from Tokens.
+func (l *lexer) Next() (Token, bool) {
+	t, ok := <-l.tokens
+	if !ok {
+		return Token{}, false
+	}
+	return Token{TokenKind(t.kind), t.val, t.line, t.pos, t.offset}, true
+}
+
+// Token is the exported form of a token, as returned by Next.
+type Token struct {
+	Kind   TokenKind
+	Val    string // the error message for errors; otherwise, the token's text
+	Line   int    // the line on which the token begins, starting from 1
+	Pos    Pos    // the byte offset of the token from the beginning of its line
+	Offset Pos    // the byte offset of the token from the beginning of the input
+}
+
+// TokenKind identifies the kind of a Token. Its String method returns
+// the names written by WriteTokensJSON, e.g. "Identifier".
+type TokenKind int
+
+func (k TokenKind) String() string {
+	return tokenType(k).String()
+}
+
+// IsError reports whether the token is a lexical error.
+func (k TokenKind) IsError() bool {
+	return tokenType(k) == tokError
+}
+
+// IsComment reports whether the token is a comment.
+func (k TokenKind) IsComment() bool {
+	return tokenType(k) == tokComment
+}
+
+// IsLiteral reports whether the token is a number, string or character
+// literal. true and false are keywords.
+func (k TokenKind) IsLiteral() bool {
+	return tokenType(k) >= tokNumber && tokenType(k) <= tokChar
+}
+
+// IsKeyword reports whether the token is a keyword.
+func (k TokenKind) IsKeyword() bool {
+	return tokenType(k) > tokKeyword && tokenType(k) < tokUserUnaryOp
+}
+
+// IsOperator reports whether the token is a built-in or user-defined
+// operator.
+func (k TokenKind) IsOperator() bool {
+	return tokenType(k) >= tokUserUnaryOp
+}
+
 // l.next() returns eof to signal end of file to a stateFn.
 const eof = -1
 
+// bom is the UTF-8 encoded byte order mark, which some editors put at
+// the beginning of files.
+const bom = "\uFEFF"
+
 // word returns the value of the token that would be emitted if
 // l.emit() were to be called.
 func (l *lexer) word() string {
@@ -184,8 +418,23 @@ func (l *lexer) word() string {
 // the input.
 func (l *lexer) next() rune {
 	if int(l.pos) >= len(l.line) {
-		if l.scanner.Scan() {
-			l.line = l.scanner.Text() + "\n"
+		l.clock.stop() // don't count time waiting on input
+		scanned := l.scanner.Scan()
+		l.clock.start()
+		if scanned {
+			// tokens don't span lines (block comments keep their own
+			// text), so the old line is no longer needed. A backup
+			// after this only returns to the start of the new line.
+			l.lineStart += l.lineLen
+			raw := l.scanner.Text()
+			l.lineLen = Pos(len(raw))
+			l.line = strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r") + "\n"
+			l.lineCount++
+			if l.lineCount == 1 && strings.HasPrefix(l.line, bom) {
+				l.line = l.line[len(bom):]
+				l.lineStart += Pos(len(bom))
+				l.lineLen -= Pos(len(bom))
+			}
 			l.pos = 0
 			l.start = 0
 			l.width = 0
@@ -208,9 +457,12 @@ func (l *lexer) peek() rune {
 	return r
 }
 
-// backup moves the scan back one rune.
+// backup moves the scan back one rune. It only undoes the last call to
+// next: calling it again does nothing, rather than moving pos into the
+// middle of a rune or, after a new line was read, before the line.
 func (l *lexer) backup() {
 	l.pos -= l.width
+	l.width = 0
 }
 
 // ignore skips the pending input before this point.
@@ -225,25 +477,41 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
-// errorf sending an error token and terminates the scan by passing nil as the next stateFn
+// errorf sends an error token for the text scanned since the last
+// token, skips that text and resumes lexing at the top level, so that
+// one bad token doesn't hide the mistakes after it.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.tokens <- token{
-		kind: tokError,
-		pos:  l.start,
-		val:  fmt.Sprintf(format, args...)}
-	return nil
+	l.send(token{
+		kind:   tokError,
+		pos:    l.start,
+		val:    fmt.Sprintf(format, args...),
+		line:   l.lineCount,
+		offset: l.lineStart + l.start,
+		src:    l.line})
+	l.start = l.pos
+	return lexTopLevel
 }
 
 // emit passes the current token.
 func (l *lexer) emit(tt tokenType) {
-	l.tokens <- token{
-		kind: tt,
-		pos:  l.start,
-		val:  l.word(),
-	}
+	l.send(token{
+		kind:   tt,
+		pos:    l.start,
+		val:    l.word(),
+		line:   l.lineCount,
+		offset: l.lineStart + l.start,
+		src:    l.line,
+	})
 	l.start = l.pos
 }
 
+// send passes t to the consumer of the lexer's tokens.
+func (l *lexer) send(t token) {
+	l.clock.stop() // don't count time blocked on the parser
+	l.tokens <- t
+	l.clock.start()
+}
+
 // run runs the state machine for the lexer.
 func (l *lexer) run() {
 	for {
@@ -252,21 +520,38 @@ func (l *lexer) run() {
 			close(l.tokens) // tokEndOfTokens is the zero value of token
 			return
 		}
+		l.clock.start()
 
 		// reset Lexer for new file.
-		l.name = f.Name()
-		l.scanner = bufio.NewScanner(f)
+		l.name = f.name
+		r, err := l.decode(f.r)
+		if err != nil {
+			l.send(token{kind: tokError, val: err.Error()})
+			if c, ok := f.r.(io.Closer); ok {
+				c.Close()
+			}
+			l.clock.stop()
+			continue
+		}
+		l.scanner = bufio.NewScanner(r)
+		l.scanner.Split(scanRawLines)
+		if l.maxLineLength > 0 {
+			l.scanner.Buffer(nil, l.maxLineLength)
+		}
 		l.line = ""
 		l.pos = 0
 		l.start = 0
 		l.width = 0
+		l.lineCount = 0
+		l.lineStart = 0
+		l.lineLen = 0
 		l.parenDepth = 0
 
 		// emit a new file token for the parser.
-		l.tokens <- token{
+		l.send(token{
 			kind: tokNewFile,
 			val:  l.name,
-		}
+		})
 
 		// run state machine for the lexer.
 		for l.state = lexTopLevel; l.state != nil; {
@@ -274,8 +559,47 @@ func (l *lexer) run() {
 			// spew.Println("State:", runtime.FuncForPC(reflect.ValueOf(l.state).Pointer()).Name())
 		}
 
-		f.Close() // close file handle
+		// the scanner stops on a line it can't buffer; report it rather
+		// than silently truncating the file.
+		if err := l.scanner.Err(); err == bufio.ErrTooLong {
+			l.start = 0
+			l.errorf("%s:%d: line too long", l.name, l.lineCount+1)
+		} else if err != nil {
+			l.start = 0
+			l.errorf("%s:%d: %v", l.name, l.lineCount+1, err)
+		}
+
+		if c, ok := f.r.(io.Closer); ok {
+			c.Close() // close file handle
+		}
+		l.clock.stop()
+	}
+}
+
+// scanRawLines is a bufio.SplitFunc like bufio.ScanLines, but which
+// keeps the "\n" or "\r\n" ending each line, so that token offsets can
+// count every byte of the input.
+func scanRawLines(data []byte, atEOF bool) (advance int, line []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// decode wraps r so that it is transcoded from the lexer's input
+// encoding to UTF-8.
+func (l *lexer) decode(r io.Reader) (io.Reader, error) {
+	if l.encoding == "" {
+		return r, nil
+	}
+	enc, err := htmlindex.Get(l.encoding)
+	if err != nil {
+		return nil, fmt.Errorf("%s: unknown encoding %q", l.name, l.encoding)
 	}
+	return transform.NewReader(r, enc.NewDecoder()), nil
 }
 
 // State Functions
@@ -305,16 +629,30 @@ func lexTopLevel(l *lexer) stateFn {
 		return lexTopLevel
 	case r == '#':
 		return lexComment
+	case r == '"':
+		return lexString
 	case r == '(':
 		l.parenDepth++
 		l.emit(tokLeftParen)
 		return lexTopLevel
 	case r == ')':
-		l.parenDepth--
-		l.emit(tokRightParen)
-		if l.parenDepth < 0 {
+		if l.parenDepth == 0 {
 			return l.errorf("unexpected right paren")
 		}
+		l.parenDepth--
+		l.emit(tokRightParen)
+		return lexTopLevel
+	case r == '{':
+		l.emit(tokLeftBrace)
+		return lexTopLevel
+	case r == '}':
+		l.emit(tokRightBrace)
+		return lexTopLevel
+	case r == '[':
+		l.emit(tokLeftBracket)
+		return lexTopLevel
+	case r == ']':
+		l.emit(tokRightBracket)
 		return lexTopLevel
 	case '0' <= r && r <= '9', r == '.':
 		l.backup()
@@ -322,6 +660,10 @@ func lexTopLevel(l *lexer) stateFn {
 	case isAlphaNumeric(r):
 		l.backup()
 		return lexIdentifer
+	case multiRuneOp[string(r)+string(l.peek())] > tokUserBinaryOp:
+		l.next()
+		l.emit(multiRuneOp[l.word()])
+		return lexTopLevel
 	case op[r] > tokUserBinaryOp:
 		l.emit(op[r])
 		return lexTopLevel
@@ -331,6 +673,17 @@ func lexTopLevel(l *lexer) stateFn {
 	case l.userOperators[r] == uopUnaryOp:
 		l.emit(tokUserUnaryOp)
 		return lexTopLevel
+	case r == ':': // after user operators, as ':' is commonly user-defined
+		l.emit(tokColon)
+		return lexTopLevel
+	case r == '?': // likewise
+		l.emit(tokQuestion)
+		return lexTopLevel
+	case r == '\'': // likewise
+		return lexChar
+	case r == '\\': // likewise
+		l.emit(tokLambda)
+		return lexTopLevel
 	default:
 		return l.errorf("unrecognized character: %#U", r)
 	}
@@ -353,29 +706,264 @@ func globWhitespace(l *lexer) {
 	}
 }
 
-// lexComment runs from '#' to the end of line or end of file.
+// lexComment runs from '#' to the end of line or end of file. The
+// newline, which next adds to the last line if the file lacks one, is
+// left for lexTopLevel.
 func lexComment(l *lexer) stateFn {
+	if l.peek() == '{' {
+		return lexBlockComment
+	}
 	// for !isEOL(l.next()) {
 	// }
 	// l.backup()
-	l.pos = Pos(len(l.line))
+	l.pos = Pos(len(strings.TrimSuffix(l.line, "\n")))
 	l.emit(tokComment)
 	return lexTopLevel
 }
 
-// lexNumber globs potential number-like strings. We let the parser
-// verify that the token is actually a valid number.
-// e.g. "3.A.8" could be emitted by this function.
+// lexBlockComment runs from "#{" to the matching "}#", which may be on
+// a later line, and emits it as a single token. Block comments nest,
+// so that code containing them can be commented out. A block comment
+// that is still open at the end of the file is an error.
+func lexBlockComment(l *lexer) stateFn {
+	l.next() // '{'
+	t := token{
+		kind:   tokComment,
+		pos:    l.start,
+		line:   l.lineCount,
+		offset: l.lineStart + l.start,
+		src:    l.line,
+	}
+	text := []rune{'#', '{'}
+	for depth := 1; depth > 0; {
+		r := l.next()
+		switch {
+		case r == eof:
+			return l.errorf("unterminated block comment starting on line %d", t.line)
+		case r == '#' && l.peek() == '{':
+			depth++
+			text = append(text, r, l.next())
+		case r == '}' && l.peek() == '#':
+			depth--
+			text = append(text, r, l.next())
+		default:
+			text = append(text, r)
+		}
+	}
+	t.val = string(text)
+	l.send(t)
+	l.start = l.pos
+	return lexTopLevel
+}
+
+// lexString scans a string literal, which must end on the line it
+// began. The token's value includes the quotes and escape sequences.
+func lexString(l *lexer) stateFn {
+	for {
+		switch r := l.next(); {
+		case r == '\\':
+			r = l.next()
+			if r == eof || isEOL(r) {
+				return l.errorf("unterminated string")
+			}
+			if !strings.ContainsRune(`nt"\\`, r) {
+				skipLiteral(l, '"')
+				return l.errorf("unknown escape sequence in string: \\%c", r)
+			}
+		case r == '"':
+			l.emit(tokString)
+			return lexTopLevel
+		case r == eof || isEOL(r):
+			return l.errorf("unterminated string")
+		}
+	}
+}
+
+// lexChar scans a character literal, a single character or escape
+// sequence between single quotes, e.g. 'A' or '\n'. The token's value
+// includes the quotes.
+func lexChar(l *lexer) stateFn {
+	switch r := l.next(); {
+	case r == '\'':
+		return l.errorf("empty character literal")
+	case r == '\\':
+		r = l.next()
+		if r == eof || isEOL(r) {
+			return l.errorf("unterminated character literal")
+		}
+		if !strings.ContainsRune(`nt'\\`, r) {
+			skipLiteral(l, '\'')
+			return l.errorf("unknown escape sequence in character literal: \\%c", r)
+		}
+	case r == eof || isEOL(r):
+		return l.errorf("unterminated character literal")
+	}
+	if r := l.next(); r != '\'' {
+		for r != '\'' && r != eof && !isEOL(r) {
+			r = l.next()
+		}
+		if r == '\'' {
+			return l.errorf("character literal has more than one character")
+		}
+		return l.errorf("unterminated character literal")
+	}
+	l.emit(tokChar)
+	return lexTopLevel
+}
+
+// skipLiteral skips the rest of a string or character literal that has
+// an error, up to and including its closing quote, or else to the end
+// of the line, so that lexing resumes after it.
+func skipLiteral(l *lexer, quote rune) {
+	for r := l.next(); r != quote; r = l.next() {
+		if r == '\\' {
+			r = l.next()
+		}
+		if r == eof || isEOL(r) {
+			return
+		}
+	}
+}
+
+// decimalDigits and hexDigits are the digits of number literals.
+const (
+	decimalDigits = "0123456789"
+	hexDigits     = "0123456789abcdefABCDEF"
+)
+
+// lexNumber scans a number literal: decimal digits with an optional
+// fraction and exponent, e.g. 3.14, .5 or 6.02e23, or a hexadecimal
+// integer, e.g. 0xff. Digits may be separated by underscores.
+// Malformed numbers, such as "3.A.8", are reported whole as errors.
 func lexNumber(l *lexer) stateFn {
-	l.acceptRun("0123456789.xabcdefABCDEF")
-	// if isAlphaNumeric(l.peek()) { // probably a mistyped identifier
-	// 	l.next()
-	// 	return l.errorf("bad number syntax: %q", l.word())
-	// }
+	if rest := l.line[l.pos:]; strings.HasPrefix(rest, "0x") || strings.HasPrefix(rest, "0X") {
+		return lexHexNumber
+	}
+	digits := acceptDigits(l, decimalDigits)
+	if l.peek() == '.' {
+		l.next()
+		digits = acceptDigits(l, decimalDigits) || digits
+	}
+	if !digits { // a lone '.'
+		return lexMalformedNumber
+	}
+	if r := l.peek(); r == 'e' || r == 'E' {
+		if !acceptExponent(l) {
+			// e.g. "2ex" is the number 2 followed by the identifier ex.
+			l.emit(tokNumber)
+			return lexTopLevel
+		}
+	}
+	if l.peek() == '/' && acceptRationalTail(l) {
+		l.emit(tokRational)
+		return lexTopLevel
+	}
+	if l.peek() == 'i' && acceptIntegerSuffix(l) {
+		l.emit(tokInteger)
+		return lexTopLevel
+	}
+	if r := l.peek(); isAlphaNumeric(r) || r == '.' {
+		return lexMalformedNumber
+	}
 	l.emit(tokNumber)
 	return lexTopLevel
 }
 
+// lexHexNumber scans a hexadecimal literal, e.g. 0xff. Hex literals
+// are integers; like decimal ones, they may have an 'i' suffix.
+func lexHexNumber(l *lexer) stateFn {
+	l.next() // '0'
+	l.next() // 'x'
+	// an underscore may also follow the prefix, e.g. 0x_ff_ff.
+	if l.peek() == '_' {
+		l.next()
+	}
+	if !acceptDigits(l, hexDigits) {
+		return lexMalformedNumber
+	}
+	if l.peek() == 'i' {
+		l.next()
+	}
+	if r := l.peek(); isAlphaNumeric(r) || r == '.' {
+		return lexMalformedNumber
+	}
+	l.emit(tokInteger)
+	return lexTopLevel
+}
+
+// lexMalformedNumber reports the number being scanned as an error,
+// along with any letters, digits and dots that run on from it.
+func lexMalformedNumber(l *lexer) stateFn {
+	for r := l.next(); isAlphaNumeric(r) || r == '.'; r = l.next() {
+	}
+	l.backup()
+	return l.errorf("malformed number %q", l.word())
+}
+
+// acceptDigits consumes a run of digits from the set, reporting whether
+// there were any. Single underscores may separate the digits, as in
+// 1_000_000; an underscore is only consumed between two digits, so a
+// leading, trailing or doubled one is left to make the number malformed.
+func acceptDigits(l *lexer, digits string) bool {
+	any := false
+	for {
+		pos := l.pos
+		r := l.next()
+		switch {
+		case strings.IndexRune(digits, r) >= 0:
+			any = true
+		case r == '_' && any && strings.IndexRune(digits, l.peek()) >= 0:
+		default:
+			l.pos = pos
+			return any
+		}
+	}
+}
+
+// acceptExponent tries to consume the exponent of a number like
+// "1.5e10" or "2E-3": an 'e' or 'E', an optional sign and at least one
+// digit. If the input doesn't match, the scan is left where it started.
+func acceptExponent(l *lexer) bool {
+	pos := l.pos
+	l.next() // 'e'
+	if r := l.peek(); r == '+' || r == '-' {
+		l.next()
+	}
+	if !acceptDigits(l, decimalDigits) {
+		l.pos = pos
+		return false
+	}
+	return true
+}
+
+// acceptRationalTail tries to consume the "/den r" tail of a rational
+// literal like "3/4r". If the input doesn't match, the scan is left
+// where it started so that '/' will lex as division.
+func acceptRationalTail(l *lexer) bool {
+	pos := l.pos
+	l.next() // '/'
+	if acceptDigits(l, decimalDigits) && l.next() == 'r' && !isAlphaNumeric(l.peek()) {
+		return true
+	}
+	l.pos = pos
+	return false
+}
+
+// acceptIntegerSuffix tries to consume the 'i' suffix of an integer
+// literal like "42i". Only decimal digits may precede it.
+func acceptIntegerSuffix(l *lexer) bool {
+	if strings.Trim(l.word(), decimalDigits+"_") != "" {
+		return false
+	}
+	pos := l.pos
+	l.next() // 'i'
+	if isAlphaNumeric(l.peek()) {
+		l.pos = pos
+		return false
+	}
+	return true
+}
+
 // lexIdentfier globs unicode alpha-numerics, determines if they
 // represent a keyword or identifier, and output the appropriate
 // token. For the "binary" & "unary" keywords, we need to add their
@@ -410,6 +998,9 @@ func lexIdentifer(l *lexer) stateFn {
 func lexUserBinaryOp(l *lexer) stateFn {
 	globWhitespace(l)
 	r := l.next()
+	if !isOperatorRune(r) {
+		return l.errorf("invalid operator %q: an operator must be a single symbol", l.word())
+	}
 	l.userOperators[r] = uopBinaryOp
 	l.emit(tokUserBinaryOp)
 	return lexTopLevel
@@ -420,6 +1011,9 @@ func lexUserBinaryOp(l *lexer) stateFn {
 func lexUserUnaryOp(l *lexer) stateFn {
 	globWhitespace(l)
 	r := l.next()
+	if !isOperatorRune(r) {
+		return l.errorf("invalid operator %q: an operator must be a single symbol", l.word())
+	}
 	l.userOperators[r] = uopUnaryOp
 	l.emit(tokUserUnaryOp)
 	return lexTopLevel
@@ -442,6 +1036,13 @@ func isAlphaNumeric(r rune) bool {
 	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
+// isOperatorRune reports whether r may be defined as a user operator.
+// Any symbol will do, however many bytes it takes in UTF-8, but not
+// letters or digits, which would be lexed as part of an identifier.
+func isOperatorRune(r rune) bool {
+	return !isAlphaNumeric(r) && !isSpace(r) && !isEOL(r) && r != utf8.RuneError
+}
+
 // DumpTokens spawns a goroutine to dump incomming tokens and
 // re-emit them on the output channel.
 func DumpTokens(in <-chan token) <-chan token {
@@ -459,3 +1060,141 @@ func DumpTokens(in <-chan token) <-chan token {
 	}()
 	return out
 }
+
+// lexSource creates and runs a new lexer over the single input string.
+func lexSource(name, input string, opts Options) *lexer {
+	l := Lex(opts)
+	l.AddReader(name, strings.NewReader(input))
+	l.Done()
+	return l
+}
+
+// TokensOf lexes src to completion and returns every token produced,
+// in order. It's handy for comparing the output of the lexer across
+// changes.
+func TokensOf(src string) []Token {
+	l := lexSource("", src, Options{})
+
+	var toks []Token
+	for t, ok := l.Next(); ok; t, ok = l.Next() {
+		toks = append(toks, t)
+	}
+	return toks
+}
+
+// Incomplete reports whether src, a statement read so far, needs more
+// input before it can be parsed: it has unclosed parens or braces, ends
+// in an operator, a comma or a keyword that must be followed by more,
+// or is a definition whose body hasn't begun. The REPL uses it to keep
+// reading statements that span lines. Lexical errors are left for the
+// parser to report, so src with one isn't incomplete.
+func Incomplete(src string) bool {
+	l := lexSource("", src, Options{})
+
+	var toks []token
+	braceDepth := 0
+	lexErr := false
+	for t := range l.Tokens() {
+		switch t.kind {
+		case tokError:
+			lexErr = true // but read on, so the lexer can finish
+			continue
+		case tokSpace, tokComment, tokNewFile, tokEndOfTokens:
+			continue
+		case tokLeftBrace:
+			braceDepth++
+		case tokRightBrace:
+			braceDepth--
+		}
+		toks = append(toks, t)
+	}
+	if lexErr {
+		return false
+	}
+	// the lexer is done with parenDepth once its tokens are closed.
+	if l.parenDepth > 0 || braceDepth > 0 {
+		return true
+	}
+	if len(toks) == 0 {
+		return false
+	}
+
+	switch last := toks[len(toks)-1]; {
+	case last.kind == tokComma, last.kind == tokColon, last.kind == tokQuestion:
+		return true
+	case last.kind > tokKeyword && last.kind < tokUserUnaryOp:
+		switch last.kind {
+		case tokTrue, tokFalse, tokBreak, tokContinue:
+			return false // these are whole expressions
+		}
+		return true
+	case last.kind >= tokUserUnaryOp:
+		return last.kind != tokIncrement && last.kind != tokDecrement
+	}
+
+	// a definition is complete once its body begins after the ')' that
+	// ends the prototype and any return type annotation.
+	if toks[0].kind != tokDefine {
+		return false
+	}
+	depth, i := 0, 0
+	for ; i < len(toks); i++ {
+		if toks[i].kind == tokLeftParen {
+			depth++
+		}
+		if toks[i].kind == tokRightParen {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+	}
+	if i == len(toks) {
+		return true // the prototype hasn't ended
+	}
+	rest := toks[i+1:]
+	if len(rest) == 2 && rest[0].kind == tokColon ||
+		len(rest) == 2 && rest[0].kind == tokUserBinaryOp && rest[0].val == ":" {
+		rest = rest[2:]
+	}
+	return len(rest) == 0
+}
+
+// FormatTokens serializes toks, one per line, in a stable textual form.
+func FormatTokens(toks []Token) string {
+	var b strings.Builder
+	for _, t := range toks {
+		fmt.Fprintf(&b, "%v %d %q\n", t.Kind, t.Pos, t.Val)
+	}
+	return b.String()
+}
+
+// WriteTokensJSON drains in, writing the tokens to w as a JSON array.
+// Tokens are written as they arrive so that the output can be consumed
+// while the input is still being lexed.
+func WriteTokensJSON(w io.Writer, in <-chan token) error {
+	type jsonToken struct {
+		Kind   string `json:"kind"`
+		Value  string `json:"value"`
+		Line   int    `json:"line"`
+		Col    int    `json:"col"`
+		Offset int    `json:"offset"`
+	}
+
+	sep := "["
+	for t := range in {
+		b, err := json.Marshal(jsonToken{t.kind.String(), t.val, t.line, int(t.pos) + 1, int(t.offset)})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\n%s", sep, b); err != nil {
+			return err
+		}
+		sep = ","
+	}
+	if sep == "[" { // no tokens at all
+		_, err := fmt.Fprintln(w, "[]")
+		return err
+	}
+	_, err := fmt.Fprintln(w, "\n]")
+	return err
+}
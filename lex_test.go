@@ -0,0 +1,206 @@
+package kaleidoscope
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// identifierOffsets returns the offsets of the identifiers lexed from
+// src.
+func identifierOffsets(src string) []Pos {
+	var offsets []Pos
+	for _, t := range TokensOf(src) {
+		if tokenType(t.Kind) == tokIdentifier {
+			offsets = append(offsets, t.Offset)
+		}
+	}
+	return offsets
+}
+
+func TestOffsetsWithLineEndings(t *testing.T) {
+	for _, tt := range []struct {
+		name, src string
+		want      []Pos
+	}{
+		{"LF", "a\nb\n  c", []Pos{0, 2, 6}},
+		{"CRLF", "a\r\nb\r\n  c", []Pos{0, 3, 8}},
+		{"mixed", "a\r\nb\n  c\r\n", []Pos{0, 3, 7}},
+	} {
+		if got := identifierOffsets(tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got offsets %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTokensOf(t *testing.T) {
+	tok := func(kind tokenType, val string, pos Pos) Token {
+		return Token{TokenKind(kind), val, 1, pos, pos}
+	}
+	want := []Token{
+		{Kind: TokenKind(tokNewFile)},
+		tok(tokIdentifier, "f", 0),
+		tok(tokLeftParen, "(", 1),
+		tok(tokIdentifier, "x", 2),
+		tok(tokRightParen, ")", 3),
+		tok(tokPlus, "+", 4),
+		tok(tokNumber, "1", 5),
+	}
+	if got := TokensOf("f(x)+1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tokens\n%swant\n%s", FormatTokens(got), FormatTokens(want))
+	}
+}
+
+func TestTokensJSON(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	var b bytes.Buffer
+	src := "f(\"say \\\"hi\\\"\")\n"
+	if err := e.WriteTokensJSON(&b, Input{"tokens.k", strings.NewReader(src)}); err != nil {
+		t.Fatal(err)
+	}
+	var toks []struct {
+		Kind, Value string
+		Line, Col   int
+	}
+	if err := json.Unmarshal(b.Bytes(), &toks); err != nil {
+		t.Fatalf("%v in:\n%s", err, b.String())
+	}
+	var kinds []string
+	for _, tok := range toks {
+		if tok.Line == 1 {
+			kinds = append(kinds, fmt.Sprintf("%s %d %s", tok.Kind, tok.Col, tok.Value))
+		}
+	}
+	want := []string{"Identifier 1 f", "LeftParen 2 (", `String 3 "say \"hi\""`, "RightParen 15 )"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got tokens %q, want %q", kinds, want)
+	}
+}
+
+// TestLexEntryPoints checks that lexing a file gives the same tokens as
+// lexing its contents as a string.
+func TestLexEntryPoints(t *testing.T) {
+	const src = "def binary | 5 (a, b) a + b\n1 | 2 # comment\nprints(\"x\")\n"
+	name := filepath.Join(t.TempDir(), "entry.k")
+	if err := ioutil.WriteFile(name, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Lex(Options{})
+	go func() {
+		l.Add(f) // closed once it's lexed
+		l.Done()
+	}()
+	drain := func(l *lexer) []token {
+		var toks []token
+		for tok := range l.Tokens() {
+			toks = append(toks, tok)
+		}
+		return toks
+	}
+	fromFile, fromString := drain(l), drain(lexSource(name, src, Options{}))
+	if !reflect.DeepEqual(fromFile, fromString) {
+		t.Errorf("lexing a file gave %v, but lexing a string gave %v", fromFile, fromString)
+	}
+}
+
+// TestEncodings checks that a UTF-8 byte order mark is skipped and that
+// Latin-1 input is transcoded.
+func TestEncodings(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	if got, err := e.Run("\xef\xbb\xbf1 + 2"); err != nil || got != 3 {
+		t.Errorf("with a byte order mark, got %v, %v, want 3", got, err)
+	}
+	var got []string
+	for tok := range lexSource("", "\"caf\xe9\"", Options{Encoding: "latin1"}).Tokens() {
+		if tok.kind == tokString || tok.kind == tokError {
+			got = append(got, tok.val)
+		}
+	}
+	if want := []string{`"café"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lexing Latin-1 gave %q, want %q", got, want)
+	}
+}
+
+// TestLongLines checks that a line longer than bufio's default 64KB
+// limit is an error, not silently truncated, unless MaxLineLength
+// allows it.
+func TestLongLines(t *testing.T) {
+	src := "1 +" + strings.Repeat(" ", 70000) + "2\n"
+	if _, err := newTestEngine(t, Options{}).Run(src); err == nil {
+		t.Errorf("a line of %d bytes was accepted", len(src))
+	}
+	long := newTestEngine(t, Options{MaxLineLength: 1 << 17})
+	if got, err := long.Run(src); err != nil || got != 3 {
+		t.Errorf("with MaxLineLength %d, got %v, %v, want 3", 1<<17, got, err)
+	}
+}
+
+// TestPeekAtLineEnd checks the tokens lexed where the lexer peeks past
+// the last rune of a line, which mustn't move the scan back into the
+// line before.
+func TestPeekAtLineEnd(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want []string // each token's line and value
+	}{
+		{"a +\nb", []string{"1 a", "1 +", "2 b"}},
+		{"a =\n=b", []string{"1 a", "1 =", "2 =", "2 b"}},
+		{"12\n.5", []string{"1 12", "2 .5"}},
+		{"f(x)\n(y)", []string{"1 f", "1 (", "1 x", "1 )", "2 (", "2 y", "2 )"}},
+		{"#{ a }#\n# b\nc", []string{"1 #{ a }#", "2 # b", "3 c"}},
+		{"#{ a\n}#b", []string{"1 #{ a\n}#", "2 b"}},
+	} {
+		var got []string
+		for tok := range lexSource("", tt.src, Options{}).Tokens() {
+			switch tok.kind {
+			case tokNewFile, tokSpace:
+			default:
+				got = append(got, fmt.Sprintf("%d %s", tok.line, tok.val))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q gave tokens %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// TestMultibyteOperators checks that user operators of 2-, 3- and 4-byte
+// runes lex, where they're defined and where they're used, and parse,
+// and that a letter can't be an operator.
+func TestMultibyteOperators(t *testing.T) {
+	for _, op := range []string{"¬", "∆", "🙂"} {
+		src := "def binary " + op + " 10 (a, b) a - b\n3 " + op + " 1"
+		var got []string
+		for tok := range lexSource("", src, Options{}).Tokens() {
+			if tok.kind == tokUserBinaryOp || tok.kind == tokError {
+				got = append(got, tok.val)
+			}
+		}
+		if want := []string{op, op}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d-byte operator: got operators %q, want %q", len(op), got, want)
+		}
+		if got, want := Format(parseOne(t, src)), "3 "+op+" 1"; got != want {
+			t.Errorf("%d-byte operator: parsed %s, want %s", len(op), got, want)
+		}
+	}
+
+	var got []token
+	for tok := range lexSource("", "def binary é 10 (a, b) a", Options{}).Tokens() {
+		if tok.kind == tokUserBinaryOp || tok.kind == tokError {
+			got = append(got, tok)
+		}
+	}
+	if len(got) != 1 || got[0].kind != tokError || got[0].val != `invalid operator "é": an operator must be a single symbol` {
+		t.Errorf("the letter é as an operator gave %v, want an error", got)
+	}
+}
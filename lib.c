@@ -9,4 +9,10 @@ double putchard(double x) {
     putchar((char)x);
     fflush(stdout);
     return 0;
-}
\ No newline at end of file
+}
+
+double prints(const char *s) {
+    fputs(s, stdout);
+    fflush(stdout);
+    return 0;
+}
@@ -1,4 +1,4 @@
-package main
+package kaleidoscope
 
 // Want to call a Go function from kaleidoscope?
 // Good news! Here's how:
@@ -13,7 +13,13 @@ package main
 
 // #include <stdio.h>
 import "C"
-import "fmt"
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
 
 //export cgoputchard
 func cgoputchard(x C.double) C.double {
@@ -35,3 +41,41 @@ func printd(x float64) float64 {
 	fmt.Println(x)
 	return 0
 }
+
+// print, println and getchard are builtins; see builtins in codegen.go.
+
+// Stdin is the buffered reader getchard reads from. Programs that also
+// read statements from stdin, like the command's REPL, should read them
+// from Stdin too, so that neither takes input buffered for the other:
+// getchard then reads what follows the statement calling it.
+var Stdin = bufio.NewReader(os.Stdin)
+
+//export getchard
+func getchard() float64 {
+	c, err := Stdin.ReadByte()
+	if err != nil {
+		return -1
+	}
+	return float64(c)
+}
+
+//export print
+func print(x float64) float64 {
+	fmt.Print(formatDouble(x))
+	return 0
+}
+
+//export println
+func println(x float64) float64 {
+	fmt.Println(formatDouble(x))
+	return 0
+}
+
+// formatDouble formats x in as few digits as identify it, without an
+// exponent unless x is very large or small: 1000000 rather than 1e+06.
+func formatDouble(x float64) string {
+	if a := math.Abs(x); a != 0 && (a < 1e-4 || a >= 1e21) {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(x, 'f', -1, 64)
+}
@@ -6,7 +6,7 @@
 //
 // 1. Run:
 //     clang -dynamiclib libExt.c
-// 2. Add to main package:
+// 2. Add to the kaleidoscope package:
 //     err := llvm.LoadLibraryPermanently("./a.out")
 //     check(err)
 // 3. Now kaleidoscope can see the a.out dynamic
@@ -0,0 +1,78 @@
+package kaleidoscope
+
+// Binding externs to the C math library. Cgo can't take the address of
+// a C function without a wrapper, so the preamble stores them.
+
+// #cgo LDFLAGS: -lm
+// #include <math.h>
+//
+// void *libm_sin = (void *)sin;
+// void *libm_cos = (void *)cos;
+// void *libm_tan = (void *)tan;
+// void *libm_asin = (void *)asin;
+// void *libm_acos = (void *)acos;
+// void *libm_atan = (void *)atan;
+// void *libm_atan2 = (void *)atan2;
+// void *libm_exp = (void *)exp;
+// void *libm_log = (void *)log;
+// void *libm_log10 = (void *)log10;
+// void *libm_sqrt = (void *)sqrt;
+// void *libm_pow = (void *)pow;
+// void *libm_fabs = (void *)fabs;
+// void *libm_floor = (void *)floor;
+// void *libm_ceil = (void *)ceil;
+// void *libm_fmod = (void *)fmod;
+import "C"
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/ajsnow/llvm"
+)
+
+// cFunc is a C function that externs may be bound to. All of them take
+// and return doubles.
+type cFunc struct {
+	addr  unsafe.Pointer
+	arity int
+}
+
+// libm holds the functions of the C math library. Externs of them are
+// bound to their addresses in our process, so 'extern cos(x)' calls
+// libm's cos whether or not the JIT's own symbol lookup can find it.
+var libm = map[string]cFunc{
+	"sin":   {C.libm_sin, 1},
+	"cos":   {C.libm_cos, 1},
+	"tan":   {C.libm_tan, 1},
+	"asin":  {C.libm_asin, 1},
+	"acos":  {C.libm_acos, 1},
+	"atan":  {C.libm_atan, 1},
+	"atan2": {C.libm_atan2, 2},
+	"exp":   {C.libm_exp, 1},
+	"log":   {C.libm_log, 1},
+	"log10": {C.libm_log10, 1},
+	"sqrt":  {C.libm_sqrt, 1},
+	"pow":   {C.libm_pow, 2},
+	"fabs":  {C.libm_fabs, 1},
+	"floor": {C.libm_floor, 1},
+	"ceil":  {C.libm_ceil, 1},
+	"fmod":  {C.libm_fmod, 2},
+}
+
+// bindExtern maps f, the function declared by the extern proto, to the
+// libm function of the same name, if there is one. The declaration must
+// match the C function's signature, or calls to it would pass their
+// arguments in the wrong registers.
+func (ctx *genContext) bindExtern(proto *fnPrototypeNode, f llvm.Value) error {
+	c, ok := libm[proto.name]
+	if !ok {
+		return nil
+	}
+	typed := proto.retType != "" || strings.Join(proto.argTypes, "") != ""
+	if len(proto.args) != c.arity || typed {
+		return fmt.Errorf("extern %s must take %d double argument(s) and return a double", proto.name, c.arity)
+	}
+	ctx.execEngine.AddGlobalMapping(f, c.addr)
+	return nil
+}
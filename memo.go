@@ -0,0 +1,55 @@
+package kaleidoscope
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/ajsnow/llvm"
+)
+
+// memoEntry is the code compiled for a top-level expression.
+type memoEntry struct {
+	fn        llvm.Value
+	intResult bool
+	calls     []string // the functions and operators the expression uses; see callees
+}
+
+// memoKey returns a hash of the structure of the tree rooted at n,
+// which is the same for identical expressions wherever they appear.
+func memoKey(n node) [sha256.Size]byte {
+	b, err := json.Marshal(withoutPositions(astJSON(n)))
+	if err != nil {
+		panic(err) // astJSON only returns values that encode
+	}
+	return sha256.Sum256(b)
+}
+
+// withoutPositions removes the "pos" fields from v, a value returned by
+// astJSON.
+func withoutPositions(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		delete(v, "pos")
+		for _, e := range v {
+			withoutPositions(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			withoutPositions(e)
+		}
+	}
+	return v
+}
+
+// forget removes the expressions that call name from the memo, as name
+// is being defined again.
+func (c *CodeGenContext) forget(name string) {
+	for k, e := range c.memo {
+		for _, callee := range e.calls {
+			if callee == name {
+				delete(c.memo, k)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package kaleidoscope
+
+import "testing"
+
+// TestMemoize checks that an expression given again reuses the code
+// compiled for it, and that redefining a function it calls forgets it.
+func TestMemoize(t *testing.T) {
+	e := newTestEngine(t, Options{Memoize: true, Redefine: true})
+	run := func(src string, want float64) {
+		t.Helper()
+		if got, err := e.Run(src); err != nil || got != want {
+			t.Fatalf("%s gave %v, %v, want %v", src, got, err, want)
+		}
+	}
+	if err := e.Compile("def sq(x) x * x"); err != nil {
+		t.Fatal(err)
+	}
+	run("sq(3)", 9)
+	key := memoKey(parseOne(t, "sq(3)"))
+	first := e.memo[key].fn
+	run("sq(3)", 9)
+	if len(e.memo) != 1 || e.memo[key].fn != first {
+		t.Errorf("sq(3) was compiled again")
+	}
+	if err := e.Compile("def sq(x) x * x + 1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.memo) != 0 {
+		t.Errorf("redefining sq kept %d memoized expression(s)", len(e.memo))
+	}
+	run("sq(3)", 10)
+}
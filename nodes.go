@@ -1,4 +1,4 @@
-package main
+package kaleidoscope
 
 import "github.com/ajsnow/llvm"
 
@@ -8,7 +8,7 @@ type node interface {
 	Kind() nodeType
 	// String() string
 	Position() Pos
-	codegen() llvm.Value
+	codegen(ctx *genContext) llvm.Value
 }
 
 type nodeType int
@@ -31,19 +31,35 @@ func (t nodeType) Kind() nodeType {
 const (
 	// literals
 	nodeNumber nodeType = iota
+	nodeInteger
+	nodeRational
+	nodeString
+	nodeBool
 
 	// expressions
 	nodeIf
 	nodeFor
+	nodeWhile
+	nodeDoWhile
 	nodeUnary
 	nodeBinary
 	nodeFnCall
 	nodeVariable
 	nodeVariableExpr
+	nodeIndex
+	nodeNestedFunction
+	nodeLambda
+	nodeBlock
+	nodeReturn
+	nodeIncDec
+	nodeBreak
+	nodeContinue
 
 	// non-expression statements
 	nodeFnPrototype
 	nodeFunction
+	nodeEnum
+	nodeGlobalVar
 
 	// other
 	nodeList
@@ -56,6 +72,41 @@ type numberNode struct {
 	val float64
 }
 
+// integerNode is an integer literal, e.g. 42i.
+type integerNode struct {
+	nodeType
+	Pos
+
+	val int64
+}
+
+// rationalNode is an exact num/den literal such as 3/4r. We don't yet
+// have a runtime rational type, so codegen lowers it to the nearest
+// double (with a warning).
+type rationalNode struct {
+	nodeType
+	Pos
+
+	num int64
+	den int64
+}
+
+// stringNode is a string literal, with its escape sequences replaced.
+type stringNode struct {
+	nodeType
+	Pos
+
+	val string
+}
+
+// boolNode is a boolean literal, true or false.
+type boolNode struct {
+	nodeType
+	Pos
+
+	val bool
+}
+
 // func NewNumberNode(t token, val float64) *numberNode {
 // 	return &numberNode{
 // 		nodeType: nodeNumber,
@@ -93,12 +144,33 @@ type forNode struct {
 	test    node
 	step    node
 	body    node
+	result  node // optional; the value of the loop, evaluated once it finishes
 }
 
 // func NewForNode(t token, counter string, start, test, step, body node) *forNode {
 // 	return &forNode{nodeFor, t.pos, counter, start, test, step, body}
 // }
 
+// whileNode runs body for as long as cond is non-zero; cond is tested
+// before each iteration.
+type whileNode struct {
+	nodeType
+	Pos
+
+	cond node
+	body node
+}
+
+// doWhileNode runs body, then runs it again for as long as cond is
+// non-zero; cond is tested after each iteration.
+type doWhileNode struct {
+	nodeType
+	Pos
+
+	body node
+	cond node
+}
+
 type unaryNode struct {
 	nodeType
 	Pos
@@ -122,6 +194,7 @@ type fnCallNode struct {
 
 	callee string
 	args   [](node)
+	tail   bool // the call is in tail position: its result is returned directly
 }
 
 type variableNode struct {
@@ -138,10 +211,79 @@ type variableExprNode struct {
 	vars []struct {
 		name string
 		node node
+		size int // the number of elements of an array; 0 if it's not one
 	}
+	body node // nil for declarations in blocks, which last until the block's end
+}
+
+// indexNode is the element of the array variable name at index.
+type indexNode struct {
+	nodeType
+	Pos
+
+	name  string
+	index node
+}
+
+// lambdaNode is an anonymous function, e.g. \(x, y) x + y. fn is a
+// functionNode with no name.
+type lambdaNode struct {
+	nodeType
+	Pos
+
+	fn node
+}
+
+// nestedFnNode defines fn, which is visible only within body.
+type nestedFnNode struct {
+	nodeType
+	Pos
+
+	fn   node
 	body node
 }
 
+// blockNode evaluates each of exprs in turn, yielding the last.
+type blockNode struct {
+	nodeType
+	Pos
+
+	exprs []node
+}
+
+// returnNode returns value from the enclosing function.
+type returnNode struct {
+	nodeType
+	Pos
+
+	value node
+}
+
+// breakNode leaves the innermost enclosing loop.
+type breakNode struct {
+	nodeType
+	Pos
+}
+
+// continueNode skips the rest of the body of the innermost enclosing
+// loop, going on to its next iteration.
+type continueNode struct {
+	nodeType
+	Pos
+}
+
+// incDecNode adds one to (op "++") or subtracts one from (op "--") the
+// named variable. Its value is the variable's new value if the operator
+// is a prefix, or its old value if it's a postfix.
+type incDecNode struct {
+	nodeType
+	Pos
+
+	op     string
+	prefix bool
+	name   string
+}
+
 type fnPrototypeNode struct {
 	nodeType
 	Pos
@@ -150,14 +292,48 @@ type fnPrototypeNode struct {
 	args       []string
 	isOperator bool
 	precedence int
+	argTypes   []string // type names of args; "" for the default double
+	retType    string   // type name of the return value; "" for the default double
 }
 
 type functionNode struct {
 	nodeType
 	Pos
 
-	proto node
-	body  node
+	proto     node
+	body      node
+	discard   bool // for top-level expressions: run for side effects only; don't print the result
+	intResult bool // for top-level expressions: set by codegen if the result is an integer
+}
+
+// enumNode declares named constants. Members without an explicit
+// value are one more than the previous member, starting at 0.
+type enumNode struct {
+	nodeType
+	Pos
+
+	name    string
+	members []enumMember
+}
+
+type enumMember struct {
+	name  string
+	value float64
+}
+
+// globalVarNode declares variables visible to every function defined
+// after it. Locals, i.e. parameters, loop counters and variables
+// declared with 'var' in a function, shadow globals of the same name;
+// a global may not share its name with an enum member.
+type globalVarNode struct {
+	nodeType
+	Pos
+
+	vars []struct {
+		name string
+		node node // a constant initializer, or nil for 0
+		size int  // the number of elements of an array; 0 if it's not one
+	}
 }
 
 type listNode struct {
@@ -166,3 +342,122 @@ type listNode struct {
 
 	nodes []node
 }
+
+// Walk traverses the AST rooted at n in depth-first order, calling fn
+// for each node. If fn returns false, Walk skips the node's children.
+func Walk(n node, fn func(node) bool) {
+	if n == nil || !fn(n) {
+		return
+	}
+	for _, c := range children(n) {
+		Walk(c, fn)
+	}
+}
+
+// Rewrite traverses the AST rooted at n in depth-first order, replacing
+// each node with the result of calling fn on it once its children have
+// been rewritten. It returns the new root.
+func Rewrite(n node, fn func(node) node) node {
+	if n == nil {
+		return nil
+	}
+	r := func(c *node) { *c = Rewrite(*c, fn) }
+	switch n := n.(type) {
+	case *ifNode:
+		r(&n.ifN)
+		r(&n.thenN)
+		r(&n.elseN)
+	case *forNode:
+		r(&n.start)
+		r(&n.test)
+		r(&n.step)
+		r(&n.body)
+		r(&n.result)
+	case *whileNode:
+		r(&n.cond)
+		r(&n.body)
+	case *doWhileNode:
+		r(&n.body)
+		r(&n.cond)
+	case *unaryNode:
+		r(&n.operand)
+	case *indexNode:
+		r(&n.index)
+	case *binaryNode:
+		r(&n.left)
+		r(&n.right)
+	case *fnCallNode:
+		for i := range n.args {
+			r(&n.args[i])
+		}
+	case *variableExprNode:
+		for i := range n.vars {
+			r(&n.vars[i].node)
+		}
+		r(&n.body)
+	case *nestedFnNode:
+		r(&n.fn)
+		r(&n.body)
+	case *lambdaNode:
+		r(&n.fn)
+	case *blockNode:
+		for i := range n.exprs {
+			r(&n.exprs[i])
+		}
+	case *returnNode:
+		r(&n.value)
+	case *functionNode:
+		r(&n.body)
+	case *globalVarNode:
+		for i := range n.vars {
+			r(&n.vars[i].node)
+		}
+	}
+	return fn(n)
+}
+
+// children returns the direct sub-nodes of n. Optional sub-nodes that
+// are absent are returned as nil.
+func children(n node) []node {
+	switch n := n.(type) {
+	case *ifNode:
+		return []node{n.ifN, n.thenN, n.elseN}
+	case *forNode:
+		return []node{n.start, n.test, n.step, n.body, n.result}
+	case *whileNode:
+		return []node{n.cond, n.body}
+	case *doWhileNode:
+		return []node{n.body, n.cond}
+	case *unaryNode:
+		return []node{n.operand}
+	case *indexNode:
+		return []node{n.index}
+	case *binaryNode:
+		return []node{n.left, n.right}
+	case *fnCallNode:
+		return n.args
+	case *variableExprNode:
+		c := []node{}
+		for _, v := range n.vars {
+			c = append(c, v.node)
+		}
+		return append(c, n.body)
+	case *nestedFnNode:
+		return []node{n.fn, n.body}
+	case *lambdaNode:
+		return []node{n.fn}
+	case *blockNode:
+		return n.exprs
+	case *returnNode:
+		return []node{n.value}
+	case *functionNode:
+		return []node{n.proto, n.body}
+	case *globalVarNode:
+		c := []node{}
+		for _, v := range n.vars {
+			c = append(c, v.node)
+		}
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ajsnow/llvm"
+)
+
+// compileObject generates code for every statement in roots and, instead
+// of running them, writes the module to filename as a native object file.
+//
+// The object is linked like one compiled from C: each definition becomes
+// a global function symbol taking and returning doubles (or the types in
+// its annotations), and each extern is an undefined symbol for the
+// linker to resolve. A program's entry point is its 'def main(): int',
+// which is called from a C main function returning its result, cast to
+// a C int, as the exit status; a main of any other type is an error.
+// If there is a main, it is the only global symbol: the functions it
+// doesn't call, directly or indirectly, are removed from the object.
+// Top-level expressions can't be run ahead of time, so they're skipped;
+// call them from main instead. For example:
+//
+//	def main(): int { putchard(72); putchard(10); 0i }
+//
+//	kaleidoscope -b -c hello.o hello.k && cc hello.o lib.c -lm
+func (c *CodeGenContext) compileObject(roots <-chan node, filename string) {
+	for n := range roots {
+		if isTopLevelExpr(n) {
+			c.ctx.warning("top-level expressions aren't compiled into object files; call them from main")
+			continue
+		}
+		if _, err := c.Step(n); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v; skipping.\n", err)
+		}
+	}
+	c.ctx.optimizeModule()
+	if main := c.ctx.module.NamedFunction("main"); main.IsNil() {
+		c.ctx.warning("no main function is defined, so " + filename + " won't link into a program")
+	} else {
+		if !c.ctx.wrapMain(main) {
+			return
+		}
+		c.ctx.removeDeadFunctions()
+	}
+	if err := emitObject(c.ctx.module, filename); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// wrapMain renames f, the program's main, and defines the C main
+// function to call it. It reports an error and returns false unless f
+// was defined as 'def main(): int'.
+func (ctx *genContext) wrapMain(f llvm.Value) bool {
+	if f.BasicBlocksCount() == 0 || f.ParamsCount() != 0 || f.Type().ElementType().ReturnType() != ctx.intType() {
+		ctx.errorV("main must be defined as 'def main(): int', taking no arguments")
+		return false
+	}
+	f.SetName("main.body")
+	i32 := ctx.context.Int32Type()
+	main := ctx.namedFunction("main", i32)
+	ctx.builder.SetInsertPointAtEnd(ctx.context.AddBasicBlock(main, "entry"))
+	status := ctx.builder.CreateCall(f, nil, "status")
+	ctx.builder.CreateRet(ctx.builder.CreateIntCast(status, i32, ""))
+	return true
+}
+
+// removeDeadFunctions makes every function but main internal, then
+// deletes those unreachable from main, if there is a main. The JIT
+// needs every function for statements yet to come, so this is only for
+// ahead of time compilation and the module written once a program has
+// run.
+func (ctx *genContext) removeDeadFunctions() {
+	if ctx.module.NamedFunction("main").IsNil() {
+		return
+	}
+	pm := llvm.NewPassManager()
+	defer pm.Dispose()
+	pm.AddInternalizePass(true)
+	pm.AddGlobalDCEPass()
+	pm.Run(ctx.module)
+}
+
+// emitObject writes m to filename as an object file for the host
+// machine.
+func emitObject(m llvm.Module, filename string) error {
+	llvm.InitializeAllTargetInfos()
+	llvm.InitializeAllTargets()
+	llvm.InitializeAllTargetMCs()
+	llvm.InitializeAllAsmPrinters()
+
+	triple := llvm.DefaultTargetTriple()
+	target, err := llvm.GetTargetFromTriple(triple)
+	if err != nil {
+		return err
+	}
+	tm := target.CreateTargetMachine(triple, "", "", llvm.CodeGenLevelDefault, llvm.RelocPIC, llvm.CodeModelDefault)
+	defer tm.Dispose()
+	m.SetTarget(triple)
+	m.SetDataLayout(tm.TargetData().String())
+
+	buf, err := tm.EmitToMemoryBuffer(m, llvm.ObjectFile)
+	if err != nil {
+		return err
+	}
+	defer buf.Dispose()
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
@@ -0,0 +1,61 @@
+package kaleidoscope
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestObjectMain checks that an object file's int main is called from a
+// C main returning i32, and that a main returning a double is an error.
+func TestObjectMain(t *testing.T) {
+	dir := t.TempDir()
+	compile := func(src string) (*Engine, string) {
+		ll := filepath.Join(dir, "main.ll")
+		e := newTestEngine(t, Options{ObjectFile: filepath.Join(dir, "main.o"), EmitLLVM: ll})
+		interpret(t, e, "main.k", src)
+		return e, readFile(t, ll)
+	}
+	e, ir := compile("def main(): int 3i")
+	if ds := e.Diagnostics(); len(ds) != 0 || !strings.Contains(ir, "define i32 @main()") {
+		t.Errorf("got %v and no i32 main in:\n%s", ds, ir)
+	}
+	e, _ = compile("def main() 3")
+	if ds := e.Diagnostics(); len(ds) != 1 || ds[0].Severity != SeverityError {
+		t.Errorf("a main returning a double gave %v, want an error", ds)
+	}
+}
+
+// TestDeadFunctions checks that a function main doesn't call is left
+// out of the IR written at the end of a run, with or without an object
+// file.
+func TestDeadFunctions(t *testing.T) {
+	dir := t.TempDir()
+	const src = "def dead(x) x\ndef live(x) x + 1\ndef main(): int { live(1); 0i }"
+	ll := filepath.Join(dir, "dead.ll")
+	for _, opts := range []Options{
+		{EmitLLVM: ll},
+		{EmitLLVM: ll, ObjectFile: filepath.Join(dir, "dead.o")},
+	} {
+		interpret(t, newTestEngine(t, opts), "dead.k", src)
+		ir := readFile(t, ll)
+		if !strings.Contains(ir, "@live(") || strings.Contains(ir, "@dead(") {
+			t.Errorf("with ObjectFile %q, want only live in:\n%s", opts.ObjectFile, ir)
+		}
+	}
+}
+
+// TestEmitBitcode checks that bitcode is written at the end of a run,
+// without the functions main doesn't call.
+func TestEmitBitcode(t *testing.T) {
+	bc := filepath.Join(t.TempDir(), "out.bc")
+	e := newTestEngine(t, Options{EmitBitcode: bc})
+	interpret(t, e, "bitcode.k", "def uncalledfn(x) x\ndef calledfn(x) x + 1\ndef main(): int { calledfn(1); 0i }")
+	got := readFile(t, bc)
+	if !strings.HasPrefix(got, "BC\xc0\xde") {
+		t.Fatalf("%s isn't bitcode: %q", bc, got)
+	}
+	if !strings.Contains(got, "calledfn") || strings.Contains(got, "uncalledfn") {
+		t.Errorf("want only calledfn in the bitcode")
+	}
+}
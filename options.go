@@ -0,0 +1,71 @@
+package kaleidoscope
+
+import (
+	"io"
+	"time"
+)
+
+// Options configures the compiler pipeline.
+type Options struct {
+	OptLevel          int    // optimization level from 0 (none) to 3
+	WarningsAsErrors  bool   // report warnings as errors, and fail Interpret if there are any
+	WarnUnused        bool   // warn about variables and parameters that are never used
+	QuietDiagnostics  bool   // don't print errors and warnings to stderr, only collect them; see Engine.Diagnostics
+	PrintTokens       bool   // dump each token as it's lexed, for Interpret
+	PrintAST          bool   // dump each top-level AST as it's parsed, for Interpret
+	RequireSemicolons bool   // top-level statements must be terminated by ';'
+	MaxLineLength     int    // longest input line the lexer accepts, in bytes; 0 means bufio.MaxScanTokenSize
+	Encoding          string // character encoding of the input, e.g. "latin1"; "" means UTF-8
+	PrintLLVMIR       bool   // dump the IR generated for each top-level statement
+	Peephole          bool   // simplify the AST before code generation; see Peephole
+	UnsafePeephole    bool   // also make peephole rewrites that change floating point semantics
+	ObjectFile        string // if set, write a native object file here instead of running the program
+	EmitLLVM          string // if set, write the IR of the module to this file once the program has run, less what a main doesn't call
+	EmitBitcode       string // if set, write the module to this file as bitcode once the program has run, less what a main doesn't call
+	EmitLLVMBoth      string // if set, write each function's IR before and after optimization to this base name + ".unopt.ll" and ".opt.ll"
+	WholeProgram      bool   // read all input before compiling, so functions may be used before they're defined
+	Time              bool   // print the time spent generating and running each top-level statement to stderr
+	Serial            bool   // lex and parse all input before running any of it, so output isn't interleaved
+	DecimalSep        string // separates the integer and fractional parts of printed results; "" means "."
+	GroupSep          string // separates groups of three integer digits in printed results; "" means none
+	BoundsCheck       bool   // abort the program if an array index is out of range
+	TrapDivZero       bool   // abort the program if it divides by zero
+	Redefine          bool   // a definition of a function that's already defined replaces it, as in the REPL
+	Memoize           bool   // reuse the code compiled for an expression when it's given again, as in the REPL
+
+	// Precedence overrides the precedences of built-in binary
+	// operators; see ParsePrecedences. NewEngine fails if it gives
+	// one for any other operator.
+	Precedence map[string]int
+
+	// IntWidth is the number of bits in an int: 8, 16, 32 or 64. Zero
+	// means 64. Integer literals must fit in it, and constant integer
+	// expressions are folded at this width, wrapping around as they
+	// would at run time.
+	IntWidth int
+
+	// StackGuard, if positive, limits how deeply calls of functions
+	// that might recurse may nest. An expression that goes deeper
+	// fails, rather than overflowing the stack and crashing the
+	// process. Tail calls count, too. In an object file, calls that
+	// are too deep return zero.
+	StackGuard int
+
+	// Timeout, if positive, limits how long each top-level expression
+	// may run. The JIT'd code can't be interrupted, so an expression
+	// that times out is abandoned, still running, and no further
+	// statements are executed.
+	Timeout time.Duration
+
+	// Profile, if non-nil, accumulates the time spent in each stage.
+	Profile *Profile
+
+	// Stats, if non-nil, is filled in with counts of the code
+	// generated once Interpret returns.
+	Stats *Stats
+
+	// Output is where Interpret prints the results of top-level
+	// expressions; nil means os.Stdout. What the program itself
+	// prints, with putchard and the like, always goes to stdout.
+	Output io.Writer
+}
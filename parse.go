@@ -1,9 +1,12 @@
-package main
+package kaleidoscope
 
 import (
 	"fmt"
-	"os"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/ajsnow/llvm"
 	"github.com/davecgh/go-spew/spew"
@@ -16,27 +19,196 @@ import (
 // input (and/or allows us to use one parser during interactive mode instead
 // of creating a new one for each line).
 type parser struct {
-	name               string         // name of current file whose tokens are being recieved; used in error reporting
-	tokens             <-chan token   // channel of tokens from the lexer
-	token              token          // current token, most reciently recieved
-	topLevelNodes      chan node      // channel of parsed top-level statements
-	binaryOpPrecedence map[string]int // maps binary operators to the precidence determining the order of operations
+	name               string           // name of current file whose tokens are being recieved; used in error reporting
+	tokens             <-chan token     // channel of tokens from the lexer
+	token              token            // current token, most reciently recieved
+	topLevelNodes      chan node        // channel of parsed top-level statements
+	binaryOpPrecedence *precedenceTable // maps binary operators to the precidence determining the order of operations
+	opaqueTypes        map[string]bool  // names declared with 'extern type'
+	requireSemicolons  bool             // top-level statements must be terminated by ';'
+	clock              stopwatch        // time spent parsing, for profiling
+	failed             bool             // an error was found in the current top-level statement
+	errorToken         token            // the token at which the last syntax error was reported
+	diags              *diagnosticLog   // collects the syntax errors reported, if non-nil
+}
+
+// builtinPrecedence maps the built-in binary operators to their
+// precedences. They can't be redefined.
+var builtinPrecedence = map[string]int{
+	"=":  2,
+	"+=": 2,
+	"-=": 2,
+	"*=": 2,
+	"/=": 2,
+	"||": 4,
+	"&&": 5,
+	"<":  10,
+	">":  10,
+	"<=": 10,
+	">=": 10,
+	"==": 10,
+	"!=": 10,
+	"+":  20,
+	"-":  20,
+	"*":  40,
+	"/":  40,
+	"^":  50,
+}
+
+// rightAssociative are the built-in binary operators that group from
+// the right, so 2^3^2 is 2^(3^2).
+var rightAssociative = map[string]bool{
+	"^": true,
+}
+
+// precedenceTable maps binary operators to their precedences, and user
+// operators to their number of operands. User operators are added as
+// their prototypes are parsed, which makes the precedence and arity
+// given there the ones used from then on; the table may be shared by
+// several parsers so that operators stay defined from one to the next.
+type precedenceTable struct {
+	mu    sync.Mutex
+	prec  map[string]int
+	arity map[string]int
+}
+
+// newPrecedenceTable returns a table of the built-in operators, with
+// the precedences in overrides in place of their own. Overrides of
+// anything but a built-in operator are ignored; see checkPrecedences.
+func newPrecedenceTable(overrides map[string]int) *precedenceTable {
+	t := &precedenceTable{prec: map[string]int{}, arity: map[string]int{}}
+	for op, prec := range builtinPrecedence {
+		t.prec[op] = prec
+	}
+	for op, prec := range overrides {
+		if _, ok := builtinPrecedence[op]; ok {
+			t.prec[op] = prec
+		}
+	}
+	return t
+}
+
+// checkPrecedences returns an error if overrides gives the precedence
+// of anything but a built-in binary operator.
+func checkPrecedences(overrides map[string]int) error {
+	for op := range overrides {
+		if _, ok := builtinPrecedence[op]; !ok {
+			return fmt.Errorf("can't set the precedence of %s, which isn't a built-in binary operator", op)
+		}
+	}
+	return nil
+}
+
+// ParsePrecedences parses a comma-separated list of operators and the
+// precedences to give them, e.g. "+=15,*=50", for Options.Precedence.
+// The last '=' in each separates the operator from its precedence,
+// which must be a positive integer, and each operator must be built in.
+func ParsePrecedences(s string) (map[string]int, error) {
+	m := map[string]int{}
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		i := strings.LastIndex(f, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("precedence %q isn't of the form op=n", f)
+		}
+		op, n := strings.TrimSpace(f[:i]), strings.TrimSpace(f[i+1:])
+		prec, err := strconv.Atoi(n)
+		if err != nil || prec <= 0 {
+			return nil, fmt.Errorf("precedence of %s must be a positive integer, not %q", op, n)
+		}
+		m[op] = prec
+	}
+	if err := checkPrecedences(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// get returns the precedence of op, or 0 if it isn't an operator.
+func (t *precedenceTable) get(op string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.prec[op]
+}
+
+// define adds the user operator op with the given precedence. It fails
+// if op is built in or has already been defined with another precedence.
+func (t *precedenceTable) define(op string, prec int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := builtinPrecedence[op]; ok {
+		return fmt.Errorf("can't redefine built-in operator %s", op)
+	}
+	if old, ok := t.prec[op]; ok && old != prec {
+		return fmt.Errorf("binary %s is already defined with precedence %d", op, old)
+	}
+	t.prec[op] = prec
+	return nil
+}
+
+// setArity records that the user operator op takes n operands.
+func (t *precedenceTable) setArity(op string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.arity[op] = n
+}
+
+// arityOf returns the number of operands of the user operator op, and
+// whether it has been defined.
+func (t *precedenceTable) arityOf(op string) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.arity[op]
+	return n, ok
+}
+
+// userOperators returns the user operators defined so far, as the
+// lexer needs to know them.
+func (t *precedenceTable) userOperators() map[rune]userOpType {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[rune]userOpType, len(t.arity))
+	for op, n := range t.arity {
+		r, _ := utf8.DecodeRuneInString(op)
+		m[r] = map[int]userOpType{1: uopUnaryOp, 2: uopBinaryOp}[n]
+	}
+	return m
+}
+
+// copy returns a copy of the table's map of precedences.
+func (t *precedenceTable) copy() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string]int, len(t.prec))
+	for op, prec := range t.prec {
+		m[op] = prec
+	}
+	return m
 }
 
 // Parse creates and runs a new parser, returning a channel of
 // top-level AST sub-trees for further processing.
-func Parse(tokens <-chan token) <-chan node {
+func Parse(tokens <-chan token, opts Options) <-chan node {
+	return parse(tokens, opts, newPrecedenceTable(opts.Precedence), nil)
+}
+
+// parse is Parse with the operator precedences in prec, which user
+// operator definitions are added to, reporting syntax errors to diags,
+// which may be nil.
+func parse(tokens <-chan token, opts Options, prec *precedenceTable, diags *diagnosticLog) <-chan node {
 	p := &parser{
-		tokens:        tokens,
-		topLevelNodes: make(chan node, 100),
-		binaryOpPrecedence: map[string]int{
-			"=": 2,
-			"<": 10,
-			"+": 20,
-			"-": 20,
-			"*": 40,
-			"/": 40,
-		},
+		diags:              diags,
+		tokens:             tokens,
+		topLevelNodes:      make(chan node, 100),
+		binaryOpPrecedence: prec,
+		opaqueTypes:        map[string]bool{},
+		requireSemicolons:  opts.RequireSemicolons,
+	}
+	if opts.Profile != nil {
+		p.clock.total = &opts.Profile.Parse
 	}
 	go p.parse()
 	return p.topLevelNodes
@@ -46,26 +218,72 @@ func Parse(tokens <-chan token) <-chan node {
 // the recursive decent until a nil or top-level sub-tree is
 // returned. Non-nils are sent to the topLevelNode channel;
 // nils are discarded (they indicate either errors, semicolons
-// or file boundaries). Once the tokens channel is empty & closed,
-// it closes its own topLevelNodes channel.
+// or file boundaries). After an error, the rest of the statement is
+// skipped; see synchronize. The lexer's error tokens are reported like
+// any unexpected token, with the lexer's message. Once the tokens channel is empty & closed,
+// it closes its own topLevelNodes channel. An empty file, or one of only
+// whitespace and comments, yields nothing: its tokNewFile parses to nil
+// and the rest are skipped by next.
 func (p *parser) parse() {
-	for p.next(); p.token.kind > tokError; { //p.next() { // may want/need to switch this back once i introduce statement delineation
+	p.clock.start()
+	// each statement ends where the next can't continue it, so ';' is
+	// only needed to put several on a line: def f(x) x; f(3)
+	for p.next(); p.token.kind != tokEndOfTokens; {
+		start := p.token
+		p.failed = false
 		topLevelNode := p.parseTopLevelStmt()
+		if p.failed {
+			p.synchronize(start)
+			continue
+		}
 		if topLevelNode != nil {
+			p.clock.stop() // don't count time blocked on codegen
 			p.topLevelNodes <- topLevelNode
+			p.clock.start()
 		}
 	}
+	p.clock.stop()
+	close(p.topLevelNodes)
+}
 
-	if p.token.kind == tokError {
-		spew.Dump(p.token)
+// synchronize recovers from a syntax error in the top-level statement
+// that began with start by skipping tokens up to the beginning of the
+// next statement: a ';', a new file, or a 'def' or 'extern' at the
+// start of a line, where top-level definitions usually are. It always
+// skips at least the statement's first token, so a bad token can't be
+// parsed forever, and it stops at the end of the input. Lexical errors
+// among the tokens skipped are still reported, as they're mistakes of
+// their own.
+func (p *parser) synchronize(start token) {
+	if p.token == start {
+		p.next()
 	}
-	close(p.topLevelNodes)
+	for p.token.kind != tokEndOfTokens && !p.atStatementBoundary() {
+		if p.token.kind == tokError && p.token != p.errorToken {
+			p.diags.syntaxError(p.token, p.token.val)
+		}
+		p.next()
+	}
+}
+
+// atStatementBoundary reports whether the current token is where
+// synchronize should resume parsing.
+func (p *parser) atStatementBoundary() bool {
+	switch p.token.kind {
+	case tokSemicolon, tokNewFile:
+		return true
+	case tokDefine, tokExtern:
+		return p.token.pos == 0
+	}
+	return false
 }
 
 // next advances to the next useful token, discarding tokens
 // that the parser doesn't need to handle like whitespace and
 // comments.
 func (p *parser) next() token {
+	p.clock.stop() // don't count time blocked on the lexer
+	defer p.clock.start()
 	for p.token = <-p.tokens; p.token.kind == tokSpace ||
 		p.token.kind == tokComment; p.token = <-p.tokens {
 	}
@@ -74,12 +292,14 @@ func (p *parser) next() token {
 
 // parseTopLevelStmt determines if the current token is the
 // beginning of a function definition, external declaration or
-// a top level expression. Semicolons are ignored;
-// file transitions change the parser's file name variable.
+// a top level expression. Semicolons are ignored unless the parser
+// requires them as terminators; file transitions change the parser's
+// file name variable.
 // --
 // TODO: don't return nil for non-error, non-done conditions
 // TODO: create BadDef, BadExpr, BadExtern nodes
 func (p *parser) parseTopLevelStmt() node {
+	var n node
 	switch p.token.kind {
 	case tokNewFile:
 		p.name = p.token.val
@@ -89,12 +309,23 @@ func (p *parser) parseTopLevelStmt() node {
 		p.next()
 		return nil
 	case tokDefine:
-		return p.parseDefinition()
+		n = p.parseDefinition()
 	case tokExtern:
-		return p.parseExtern()
+		n = p.parseExtern()
+	case tokDiscard:
+		n = p.parseDiscard()
+	case tokEnum:
+		n = p.parseEnum()
+	case tokVariable:
+		n = p.parseGlobalVar()
 	default:
-		return p.parseTopLevelExpr()
+		n = p.parseTopLevelExpr()
+	}
+
+	if n != nil && p.requireSemicolons && p.token.kind != tokSemicolon {
+		return p.error(p.token, "expected ';' after top-level statement")
 	}
+	return n
 }
 
 // parseDefinition parses top level function definitions.
@@ -102,7 +333,7 @@ func (p *parser) parseDefinition() node {
 	pos := p.token.pos
 	p.next()
 	proto := p.parsePrototype()
-	if p == nil {
+	if proto == nil {
 		return nil
 	}
 
@@ -110,14 +341,105 @@ func (p *parser) parseDefinition() node {
 	if e == nil {
 		return nil
 	}
-	return &functionNode{nodeFunction, pos, proto, e}
+	return &functionNode{nodeFunction, pos, proto, e, false, false}
 }
 
+// parseEnum parses enum declarations.
+// e.g. enum Color { Red, Green = 4, Blue }
+func (p *parser) parseEnum() node {
+	pos := p.token.pos
+	p.next()
+	if p.token.kind != tokIdentifier {
+		return p.nameError("an enum name", "expected enum name")
+	}
+	e := &enumNode{nodeEnum, pos, p.token.val, nil}
+	p.next()
+	if p.token.kind != tokLeftBrace {
+		return p.error(p.token, "expected '{' after enum name")
+	}
+	p.next()
+
+	next := 0.0
+	for p.token.kind != tokRightBrace {
+		if p.token.kind != tokIdentifier {
+			return p.nameError("an enum member name", "expected enum member name")
+		}
+		name := p.token.val
+		p.next()
+		if p.token.kind == tokEqual {
+			p.next()
+			if p.token.kind != tokNumber {
+				return p.error(p.token, "expected number after '=' in enum")
+			}
+			val, err := strconv.ParseFloat(p.token.val, 64)
+			if err != nil {
+				return p.error(p.token, "invalid number")
+			}
+			next = val
+			p.next()
+		}
+		e.members = append(e.members, enumMember{name, next})
+		next++
+
+		if p.token.kind == tokComma {
+			p.next()
+			continue
+		}
+		if p.token.kind != tokRightBrace {
+			return p.error(p.token, "expected ',' or '}' in enum")
+		}
+	}
+	p.next()
+	return e
+}
+
+// parseExtern parses external function declarations and opaque
+// type declarations.
 func (p *parser) parseExtern() node {
 	p.next()
+	if p.token.kind == tokType {
+		return p.parseOpaqueType()
+	}
 	return p.parsePrototype()
 }
 
+// parseOpaqueType parses declarations of opaque types, such as C's
+// FILE*, that Kaleidoscope code can pass around but not inspect. The
+// declaration only affects parsing, so no node is returned.
+// e.g. extern type FILE
+func (p *parser) parseOpaqueType() node {
+	p.next()
+	if p.token.kind != tokIdentifier {
+		return p.error(p.token, "expected type name after 'extern type'")
+	}
+	p.opaqueTypes[p.token.val] = true
+	p.next()
+	return nil
+}
+
+// parseGlobalVar parses top-level 'var' statements. Without 'in', they
+// declare global variables, which must be initialized to constants;
+// with it, they're ordinary top-level expressions.
+// e.g. var count = 0, limit = 10i
+func (p *parser) parseGlobalVar() node {
+	pos := p.token.pos
+	keyword := p.token.val
+	v := p.parseVarDecls()
+	if v == nil {
+		return nil
+	}
+	if p.token.kind != tokIn {
+		return &globalVarNode{nodeGlobalVar, pos, v.vars}
+	}
+	p.next()
+
+	v.body = p.parseExpression()
+	if v.body == nil {
+		return p.error(p.token, "empty body in "+keyword+" expression")
+	}
+	return topLevelExpr(pos, v)
+}
+
 // parseTopLevelExpr parses top level expressions by wrapping them
 // into unnamed functions. The name "" signals that this statement
 // is to be executed directly.
@@ -127,8 +449,25 @@ func (p *parser) parseTopLevelExpr() node {
 	if e == nil {
 		return nil
 	}
-	proto := &fnPrototypeNode{nodeFnPrototype, pos, "", nil, false, 0} // fnName, ArgNames, kind != idef, precedence}
-	f := &functionNode{nodeFunction, pos, proto, e}
+	return topLevelExpr(pos, e)
+}
+
+// topLevelExpr wraps the expression e into an unnamed function.
+func topLevelExpr(pos Pos, e node) node {
+	proto := &fnPrototypeNode{nodeFnPrototype, pos, "", nil, false, 0, nil, ""} // fnName, ArgNames, kind != idef, precedence, ArgTypes, retType}
+	return &functionNode{nodeFunction, pos, proto, e, false, false}
+}
+
+// parseDiscard parses top-level expressions whose result is not to be
+// printed, i.e. that are evaluated only for their side effects.
+// e.g. discard putchard(10)
+func (p *parser) parseDiscard() node {
+	p.next()
+	f := p.parseTopLevelExpr()
+	if f == nil {
+		return nil
+	}
+	f.(*functionNode).discard = true
 	return f
 }
 
@@ -137,14 +476,19 @@ func (p *parser) parseTopLevelExpr() node {
 // the prototype is for a user-defined operator. Binary ops may have
 // an optional precedence specified to determine the order of
 // operations.
+// Arguments and the return value may be annotated with a type: int,
+// bool, string, fn (a function value) or an opaque type. Those left
+// unannotated are doubles.
 // e.g. name(arg1, arg2, arg3)
 // e.g. binary ∆ 50 (lhs rhs)
+// e.g. fclose(f: FILE)
+// e.g. llabs(n: int): int
 func (p *parser) parsePrototype() node {
 	pos := p.token.pos
 	if p.token.kind != tokIdentifier &&
 		p.token.kind != tokBinary &&
 		p.token.kind != tokUnary {
-		return Error(p.token, "expected function name in prototype")
+		return p.nameError("a function name", "expected function name in prototype")
 	}
 
 	fnName := p.token.val
@@ -157,6 +501,7 @@ func (p *parser) parsePrototype() node {
 		binary
 	)
 	kind := idef
+	op := p.token.val
 
 	switch fnName {
 	case "unary":
@@ -165,7 +510,6 @@ func (p *parser) parsePrototype() node {
 		p.next()
 	case "binary":
 		fnName += p.token.val // binary^
-		op := p.token.val
 		kind = binary
 		p.next()
 
@@ -173,32 +517,73 @@ func (p *parser) parsePrototype() node {
 			var err error
 			precedence, err = strconv.Atoi(p.token.val)
 			if err != nil {
-				return Error(p.token, "\ninvalid precedence")
+				return p.error(p.token, "\ninvalid precedence")
 			}
 			p.next()
 		}
-		p.binaryOpPrecedence[op] = precedence // make sure to take this out of codegen later if we're going to keep it here.
+		// the precedence is needed to parse the body, which may use op.
+		if err := p.binaryOpPrecedence.define(op, precedence); err != nil {
+			return p.error(p.token, err.Error())
+		}
 	}
 
 	if p.token.kind != tokLeftParen {
-		return Error(p.token, "expected '(' in prototype")
+		return p.error(p.token, "expected '(' in prototype")
 	}
 
 	ArgNames := []string{}
-	for p.next(); p.token.kind == tokIdentifier || p.token.kind == tokComma; p.next() {
-		if p.token.kind != tokComma {
-			ArgNames = append(ArgNames, p.token.val)
+	ArgTypes := []string{}
+	for p.next(); p.token.kind == tokIdentifier || p.token.kind == tokComma; {
+		if p.token.kind == tokComma {
+			p.next()
+			continue
 		}
+		ArgNames = append(ArgNames, p.token.val)
+		p.next()
+		argType, ok := p.parseTypeAnnotation()
+		if !ok {
+			return nil
+		}
+		ArgTypes = append(ArgTypes, argType)
 	}
 	if p.token.kind != tokRightParen {
-		return Error(p.token, "expected ')' in prototype")
+		return p.nameError("an argument name", "expected ')' in prototype")
 	}
 
 	p.next()
+	retType, ok := p.parseTypeAnnotation()
+	if !ok {
+		return nil
+	}
 	if kind != idef && len(ArgNames) != kind {
-		return Error(p.token, "invalid number of operands for operator")
+		return p.error(p.token, "invalid number of operands for operator")
+	}
+	if kind != idef {
+		p.binaryOpPrecedence.setArity(op, kind)
+	}
+	return &fnPrototypeNode{nodeFnPrototype, pos, fnName, ArgNames, kind != idef, precedence, ArgTypes, retType}
+}
+
+// parseTypeAnnotation parses an optional ": type" annotation, returning
+// the type's name or "" if there was no annotation. A user-defined ':'
+// operator is accepted in place of the colon.
+func (p *parser) parseTypeAnnotation() (string, bool) {
+	if p.token.kind != tokColon &&
+		!(p.token.kind == tokUserBinaryOp && p.token.val == ":") {
+		return "", true
+	}
+	p.next()
+	if p.token.kind != tokIdentifier {
+		p.error(p.token, "expected type name after ':'")
+		return "", false
+	}
+	name := p.token.val
+	if name != "int" && name != "bool" && name != "string" && name != "fn" && !p.opaqueTypes[name] {
+		p.error(p.token, "unknown type "+name)
+		return "", false
 	}
-	return &fnPrototypeNode{nodeFnPrototype, pos, fnName, ArgNames, kind != idef, precedence}
+	p.next()
+	return name, true
 }
 
 // parseExpression parses expressions. First, it tries to parse
@@ -219,13 +604,27 @@ func (p *parser) parseExpression() node {
 // not a unary operator, parse it as a primary expression; otherwise,
 // return a unaryNode, parsing the operand of the unary operator as
 // another unary expression (so as to allow chaining of unary ops).
+// '-' is a built-in unary operator, so 3 - -4 is 3 minus negated 4.
+// So are the prefix '++' and '--', whose operand must be a variable.
 func (p *parser) parseUnarty() node {
 	pos := p.token.pos
 	// If we're not an operator, parse as primary {this is correcp.}
 	if p.token.kind < tokUserUnaryOp {
 		return p.parsePrimary()
 	}
+	if p.token.kind == tokIncrement || p.token.kind == tokDecrement {
+		opTok := p.token
+		p.next()
+		v, ok := p.parseUnarty().(*variableNode)
+		if !ok {
+			return p.error(opTok, "operand of '"+opTok.val+"' must be a variable")
+		}
+		return &incDecNode{nodeIncDec, pos, opTok.val, true, v.name}
+	}
 
+	if !p.checkArity(p.token, 1) {
+		return nil
+	}
 	name := p.token.val
 	p.next()
 	operand := p.parseUnarty()
@@ -240,13 +639,27 @@ func (p *parser) parseUnarty() node {
 func (p *parser) parseBinaryOpRHS(exprPrec int, lhs node) node {
 	pos := p.token.pos
 	for {
-		if p.token.kind < tokUserUnaryOp {
+		if p.token.kind == tokIncrement || p.token.kind == tokDecrement {
+			// postfix operators are parsed with their variable.
+			return p.error(p.token, "operand of '"+p.token.val+"' must be a variable")
+		}
+		if p.token.kind < tokUserUnaryOp && p.token.kind != tokQuestion {
 			return lhs // an expression like '5' will get sent back up to parseTopLevelExpr or parseDefinition from here.
 		}
-		tokenPrec := p.getTokenPrecedence(p.token.val)
+		if !p.checkArity(p.token, 2) {
+			return nil
+		}
+		tokenPrec := p.getTokenPrecedence(p.token)
 		if tokenPrec < exprPrec {
 			return lhs
 		}
+		if p.token.kind == tokQuestion {
+			if lhs = p.parseConditional(lhs); lhs == nil {
+				return nil
+			}
+			continue
+		}
+		opTok := p.token
 		binOp := p.token.val
 		p.next()
 
@@ -255,21 +668,93 @@ func (p *parser) parseBinaryOpRHS(exprPrec int, lhs node) node {
 			return nil
 		}
 
-		nextPrec := p.getTokenPrecedence(p.token.val)
-		if tokenPrec < nextPrec {
+		nextPrec := p.getTokenPrecedence(p.token)
+		if tokenPrec == nextPrec && rightAssociative[binOp] {
+			rhs = p.parseBinaryOpRHS(tokenPrec, rhs)
+			if rhs == nil {
+				return nil
+			}
+		} else if tokenPrec < nextPrec {
 			rhs = p.parseBinaryOpRHS(tokenPrec+1, rhs)
 			if rhs == nil {
 				return nil
 			}
 		}
 
+		if op, ok := compoundAssignments[binOp]; ok {
+			// x += e is x = x + e; x is both the destination and an operand.
+			if _, ok := lhs.(*variableNode); !ok {
+				return p.error(opTok, "destination of '"+binOp+"' must be a variable")
+			}
+			rhs = &binaryNode{nodeBinary, pos, op, lhs, rhs}
+			binOp = "="
+		}
 		lhs = &binaryNode{nodeBinary, pos, binOp, lhs, rhs}
 	}
 }
 
+// checkArity reports an error if t is a user-defined operator that's
+// used with n operands but was declared with a different number.
+func (p *parser) checkArity(t token, n int) bool {
+	if t.kind != tokUserUnaryOp && t.kind != tokUserBinaryOp {
+		return true
+	}
+	declared, ok := p.binaryOpPrecedence.arityOf(t.val)
+	if !ok || declared == n {
+		return true
+	}
+	kinds := map[int]string{1: "unary", 2: "binary"}
+	p.error(t, fmt.Sprintf("operator %s is declared %s, with %d operand(s), but is used as a %s operator",
+		t.val, kinds[declared], declared, kinds[n]))
+	return false
+}
+
+// compoundAssignments maps the compound assignment operators to the
+// operators they apply before assigning.
+var compoundAssignments = map[string]string{
+	"+=": "+",
+	"-=": "-",
+	"*=": "*",
+	"/=": "/",
+}
+
+// conditionalPrecedence is the precedence of the conditional operator
+// "?:", which binds more tightly than '=' but less than '||'.
+const conditionalPrecedence = 3
+
 // getTokenPrecedence returns a binary operator's precedence
-func (p *parser) getTokenPrecedence(token string) int {
-	return p.binaryOpPrecedence[token]
+func (p *parser) getTokenPrecedence(t token) int {
+	if t.kind == tokQuestion {
+		return conditionalPrecedence
+	}
+	return p.binaryOpPrecedence.get(t.val)
+}
+
+// parseConditional parses the rest of a conditional expression after
+// its condition, cond. It's shorthand for an if expression and is
+// right-associative, so a ? b : c ? d : e is a ? b : (c ? d : e).
+// If '?' or ':' is defined as a user operator, that takes precedence.
+// e.g. x < 0 ? -x : x
+func (p *parser) parseConditional(cond node) node {
+	pos := p.token.pos
+	p.next()
+	thenN := p.parseExpression()
+	if thenN == nil {
+		return nil
+	}
+	if p.token.kind != tokColon {
+		return p.error(p.token, "expected ':' in conditional expression")
+	}
+	p.next()
+
+	elseN := p.parseUnarty()
+	if elseN == nil {
+		return nil
+	}
+	if elseN = p.parseBinaryOpRHS(conditionalPrecedence, elseN); elseN == nil {
+		return nil
+	}
+	return &ifNode{nodeIf, pos, cond, thenN, elseN}
 }
 
 // parsePrimary parses primary expressions. The parser arrives
@@ -284,29 +769,79 @@ func (p *parser) parsePrimary() node {
 		return p.parseIfExpr()
 	case tokFor:
 		return p.parseForExpr()
+	case tokWhile:
+		return p.parseWhileExpr()
+	case tokDo:
+		return p.parseDoWhileExpr()
 	case tokVariable:
 		return p.parseVarExpr()
+	case tokDefine:
+		return p.parseNestedDefExpr()
+	case tokLambda:
+		return p.parseLambdaExpr()
 	case tokNumber:
 		return p.parseNumericExpr()
+	case tokInteger:
+		return p.parseIntegerExpr()
+	case tokRational:
+		return p.parseRationalExpr()
+	case tokString:
+		return p.parseStringExpr()
+	case tokChar:
+		return p.parseCharExpr()
+	case tokTrue, tokFalse:
+		return p.parseBoolExpr()
 	case tokLeftParen:
 		return p.parseParenExpr()
+	case tokLeftBrace:
+		return p.parseBlockExpr()
+	case tokReturn:
+		return p.parseReturnExpr()
+	case tokBreak:
+		n := &breakNode{nodeBreak, p.token.pos}
+		p.next()
+		return n
+	case tokContinue:
+		n := &continueNode{nodeContinue, p.token.pos}
+		p.next()
+		return n
 	case tokEndOfTokens:
-		return nil // this token should not be skipped
+		// this token should not be skipped.
+		return p.error(p.token, "unexpected end of input when expecting expression")
 	default:
 		oldToken := p.token
 		p.next()
-		return Error(oldToken, "unknown token encountered when expecting expression")
+		return p.error(oldToken, "unknown token encountered when expecting expression")
 	}
 }
 
 // parseIdentifierExpr parses user defined identifiers (i.e. variable
 // and function names). If it is a function name, parse any arguments
-// it may take and emit a function call node. Otherwise, emit the variable.
+// it may take and emit a function call node. Otherwise, emit the variable,
+// its postfix '++' or '--' if one follows, or the array element indexed
+// if '[' follows.
 func (p *parser) parseIdentifierExpr() node {
 	pos := p.token.pos
 	name := p.token.val
 	p.next()
 	// are we a variable? else function call
+	if p.token.kind == tokIncrement || p.token.kind == tokDecrement {
+		op := p.token.val
+		p.next()
+		return &incDecNode{nodeIncDec, pos, op, false, name}
+	}
+	if p.token.kind == tokLeftBracket {
+		p.next()
+		index := p.parseExpression()
+		if index == nil {
+			return p.error(p.token, "expected index expression after '['")
+		}
+		if p.token.kind != tokRightBracket {
+			return p.error(p.token, "expected ']' after index")
+		}
+		p.next()
+		return &indexNode{nodeIndex, pos, name, index}
+	}
 	if p.token.kind != tokLeftParen {
 		return &variableNode{nodeVariable, pos, name}
 	}
@@ -324,7 +859,7 @@ func (p *parser) parseIdentifierExpr() node {
 		}
 	}
 	p.next()
-	return &fnCallNode{nodeFnCall, pos, name, args}
+	return &fnCallNode{nodeFnCall, pos, name, args, false}
 }
 
 // parseIfExpr, as the name suggest, parses each part of an if expression
@@ -335,58 +870,64 @@ func (p *parser) parseIfExpr() node {
 	p.next()
 	ifE := p.parseExpression()
 	if ifE == nil {
-		return Error(p.token, "expected condition after 'if'")
+		return p.error(p.token, "expected condition after 'if'")
 	}
 
 	if p.token.kind != tokThen {
-		return Error(p.token, "expected 'then' after if condition")
+		return p.error(p.token, "expected 'then' after if condition")
 	}
 	p.next()
 	thenE := p.parseExpression()
 	if thenE == nil {
-		return Error(p.token, "expected expression after 'then'")
+		return p.error(p.token, "expected expression after 'then'")
 	}
 
 	if p.token.kind != tokElse {
-		return Error(p.token, "expected 'else' after then expr")
+		return p.error(p.token, "expected 'else' after then expr")
 	}
 	p.next()
 	elseE := p.parseExpression()
 	if elseE == nil {
-		return Error(p.token, "expected expression after 'else'")
+		return p.error(p.token, "expected expression after 'else'")
 	}
 
 	return &ifNode{nodeIf, pos, ifE, thenE, elseE}
 }
 
-// parseIfExpr parses each part of a for expression. The increment
-// step is optional and defaults to += 1 if unspecified.
+// parseForExpr parses each part of a for expression. The increment
+// step is optional and defaults to += 1 if unspecified; it may be
+// negative, to count down. Only the test decides when the loop ends:
+// the body runs, then the loop repeats while the test is true, so
+// for i = 10, i > 0, -1 runs for 10 down to 0. The loop
+// evaluates to 0 unless a 'yielding' expression is given, in which
+// case it evaluates to that expression once the loop has finished.
+// e.g. var acc = 1 in for i = 1, i < n in acc = acc * i yielding acc
 func (p *parser) parseForExpr() node {
 	pos := p.token.pos
 	p.next()
 	if p.token.kind != tokIdentifier {
-		return Error(p.token, "expected identifier after 'for'")
+		return p.nameError("a loop variable", "expected identifier after 'for'")
 	}
 	counter := p.token.val
 
 	p.next()
 	if p.token.kind != tokEqual {
-		return Error(p.token, "expected '=' after 'for "+counter+"'")
+		return p.error(p.token, "expected '=' after 'for "+counter+"'")
 	}
 
 	p.next()
 	start := p.parseExpression()
 	if start == nil {
-		return Error(p.token, "expected expression after 'for "+counter+" ='")
+		return p.error(p.token, "expected expression after 'for "+counter+" ='")
 	}
 	if p.token.kind != tokComma {
-		return Error(p.token, "expected ',' after 'for' start expression")
+		return p.error(p.token, "expected ',' after 'for' start expression")
 	}
 
 	p.next()
 	end := p.parseExpression()
 	if end == nil {
-		return Error(p.token, "expected end expression after 'for' start expression")
+		return p.error(p.token, "expected end expression after 'for' start expression")
 	}
 
 	// optional step
@@ -394,27 +935,102 @@ func (p *parser) parseForExpr() node {
 	if p.token.kind == tokComma {
 		p.next()
 		if step = p.parseExpression(); step == nil {
-			return Error(p.token, "invalid step expression after 'for'")
+			return p.error(p.token, "invalid step expression after 'for'")
 		}
 	}
 
 	if p.token.kind != tokIn {
-		return Error(p.token, "expected 'in' after 'for' sub-expression")
+		return p.error(p.token, "expected 'in' after 'for' sub-expression")
 	}
 
 	p.next()
 	body := p.parseExpression()
 	if body == nil {
-		return Error(p.token, "expected body expression after 'for ... in'")
+		return p.error(p.token, "expected body expression after 'for ... in'")
+	}
+
+	// optional result
+	var result node
+	if p.token.kind == tokYielding {
+		p.next()
+		if result = p.parseExpression(); result == nil {
+			return p.error(p.token, "expected expression after 'yielding'")
+		}
 	}
 
-	return &forNode{nodeFor, pos, counter, start, end, step, body}
+	return &forNode{nodeFor, pos, counter, start, end, step, body, result}
+}
+
+// parseWhileExpr parses a while loop, which evaluates to 0.
+// e.g. while n < 10 in n = n + 1
+func (p *parser) parseWhileExpr() node {
+	pos := p.token.pos
+	p.next()
+	cond := p.parseExpression()
+	if cond == nil {
+		return p.error(p.token, "expected condition after 'while'")
+	}
+
+	if p.token.kind != tokIn {
+		return p.error(p.token, "expected 'in' after 'while' condition")
+	}
+	p.next()
+	body := p.parseExpression()
+	if body == nil {
+		return p.error(p.token, "expected body expression after 'while ... in'")
+	}
+	return &whileNode{nodeWhile, pos, cond, body}
+}
+
+// parseDoWhileExpr parses a do/while loop, which runs its body at least
+// once and evaluates to 0.
+// e.g. do n = n + 1 while n < 10
+func (p *parser) parseDoWhileExpr() node {
+	pos := p.token.pos
+	p.next()
+	body := p.parseExpression()
+	if body == nil {
+		return p.error(p.token, "expected body expression after 'do'")
+	}
+
+	if p.token.kind != tokWhile {
+		return p.error(p.token, "expected 'while' after 'do' body")
+	}
+	p.next()
+	cond := p.parseExpression()
+	if cond == nil {
+		return p.error(p.token, "expected condition after 'do ... while'")
+	}
+	return &doWhileNode{nodeDoWhile, pos, body, cond}
 }
 
 // parseVarExpr parses an expression declaring (and using) mutable
-// variables.
+// variables. 'let' may be used in place of 'var'.
 func (p *parser) parseVarExpr() node {
+	keyword := p.token.val
+	v := p.parseVarDecls()
+	if v == nil {
+		return nil
+	}
+
+	// 'in'
+	if p.token.kind != tokIn {
+		return p.error(p.token, "expected 'in' after '"+keyword+"'")
+	}
+	p.next()
+
+	v.body = p.parseExpression()
+	if v.body == nil {
+		return p.error(p.token, "empty body in "+keyword+" expression")
+	}
+	return v
+}
+
+// parseVarDecls parses the 'var' keyword and the variables it
+// declares, stopping short of any 'in'. The returned node has no body.
+func (p *parser) parseVarDecls() *variableExprNode {
 	pos := p.token.pos
+	keyword := p.token.val
 	p.next()
 	var v = variableExprNode{
 		nodeType: nodeVariableExpr,
@@ -422,6 +1038,7 @@ func (p *parser) parseVarExpr() node {
 		vars: []struct {
 			name string
 			node node
+			size int
 		}{},
 		body: nil,
 	}
@@ -429,25 +1046,40 @@ func (p *parser) parseVarExpr() node {
 
 	// this forloop can be simplified greatly.
 	if p.token.kind != tokIdentifier {
-		return Error(p.token, "expected identifier after var")
+		p.nameError("a variable name", "expected identifier after "+keyword)
+		return nil
 	}
 	for {
 		name := p.token.val
 		p.next()
 
+		// are we an array?
+		size := 0
+		if p.token.kind == tokLeftBracket {
+			if size = p.parseArraySize(); size == 0 {
+				return nil
+			}
+			if p.token.kind == tokEqual {
+				p.error(p.token, "arrays can't be initialized")
+				return nil
+			}
+		}
+
 		// are we initialized?
 		val = nil
 		if p.token.kind == tokEqual {
 			p.next()
 			val = p.parseExpression()
 			if val == nil {
-				return Error(p.token, "initialization failed")
+				p.error(p.token, "initialization failed")
+				return nil
 			}
 		}
 		v.vars = append(v.vars, struct {
 			name string
 			node node
-		}{name, val})
+			size int
+		}{name, val, size})
 
 		if p.token.kind != tokComma {
 			break
@@ -455,21 +1087,149 @@ func (p *parser) parseVarExpr() node {
 		p.next()
 
 		if p.token.kind != tokIdentifier {
-			return Error(p.token, "expected identifier after var")
+			p.nameError("a variable name", "expected identifier after "+keyword)
+			return nil
 		}
 	}
+	return &v
+}
+
+// parseArraySize parses the "[n]" of an array declaration, returning
+// n, or 0 if it isn't a positive integer literal.
+func (p *parser) parseArraySize() int {
+	p.next()
+	var n int64
+	switch lit := p.parsePrimary().(type) {
+	case *integerNode:
+		n = lit.val
+	case *numberNode:
+		if lit.val == math.Trunc(lit.val) && lit.val < math.MaxInt32 {
+			n = int64(lit.val)
+		}
+	}
+	if n <= 0 {
+		p.error(p.token, "array size must be a positive integer")
+		return 0
+	}
+	if p.token.kind != tokRightBracket {
+		p.error(p.token, "expected ']' after array size")
+		return 0
+	}
+	p.next()
+	return int(n)
+}
+
+// parseBlockExpr parses a brace-delimited list of expressions separated
+// by semicolons; the block's value is that of the last. Within a block,
+// 'var' without 'in' declares variables for the rest of the block.
+// e.g. { var x = 2; x = x * x; x + 1 }
+func (p *parser) parseBlockExpr() node {
+	pos := p.token.pos
+	p.next()
+	b := &blockNode{nodeBlock, pos, nil}
+	for p.token.kind != tokRightBrace {
+		var e node
+		if p.token.kind == tokVariable {
+			v := p.parseVarDecls()
+			if v == nil {
+				return nil
+			}
+			if p.token.kind == tokIn {
+				p.next()
+				if v.body = p.parseExpression(); v.body == nil {
+					return p.error(p.token, "empty body in var expression")
+				}
+			}
+			e = v
+		} else if e = p.parseExpression(); e == nil {
+			return nil
+		}
+		b.exprs = append(b.exprs, e)
+
+		if p.token.kind == tokSemicolon {
+			p.next()
+			continue
+		}
+		if p.token.kind != tokRightBrace {
+			return p.error(p.token, "expected ';' or '}' in block")
+		}
+	}
+	p.next()
+	if len(b.exprs) == 0 {
+		return p.error(p.token, "empty block")
+	}
+	return b
+}
+
+// parseLambdaExpr parses an anonymous function: '\', its parameters in
+// parentheses and its body, which extends as far as it can. The value
+// is a function that can be called through a variable or parameter of
+// type fn. Its parameters and result are doubles, and it can't see the
+// variables of the function it's in.
+// e.g. var twice = \(x) 2 * x in twice(21)
+func (p *parser) parseLambdaExpr() node {
+	pos := p.token.pos
+	p.next()
+	if p.token.kind != tokLeftParen {
+		return p.error(p.token, "expected '(' after '\\'")
+	}
+	args := []string{}
+	for p.next(); p.token.kind == tokIdentifier || p.token.kind == tokComma; p.next() {
+		if p.token.kind == tokIdentifier {
+			args = append(args, p.token.val)
+		}
+	}
+	if p.token.kind != tokRightParen {
+		return p.error(p.token, "expected ')' after the parameters of a lambda")
+	}
+	p.next()
+
+	body := p.parseExpression()
+	if body == nil {
+		return nil
+	}
+	proto := &fnPrototypeNode{nodeFnPrototype, pos, "", args, false, 0, make([]string, len(args)), ""}
+	return &lambdaNode{nodeLambda, pos, &functionNode{nodeFunction, pos, proto, body, false, false}}
+}
+
+// parseNestedDefExpr parses a function definition nested inside
+// another function. The nested function may only be called from the
+// expression following 'in'. It captures the enclosing function's
+// variables that it uses by value, as they are where it's defined;
+// assigning to them changes only its copies.
+// e.g. def sq(x) x*x in sq(a) + sq(b), or def add(x) x + a in add(b)
+func (p *parser) parseNestedDefExpr() node {
+	pos := p.token.pos
+	fn := p.parseDefinition()
+	if fn == nil {
+		return nil
+	}
+	if fn.(*functionNode).proto.(*fnPrototypeNode).isOperator {
+		return p.error(p.token, "operators must be defined at the top level")
+	}
 
-	// 'in'
 	if p.token.kind != tokIn {
-		return Error(p.token, "expected 'in' after 'var'")
+		return p.error(p.token, "expected 'in' after nested definition")
 	}
 	p.next()
 
-	v.body = p.parseExpression()
-	if v.body == nil {
-		return Error(p.token, "empty body in var expression")
+	body := p.parseExpression()
+	if body == nil {
+		return p.error(p.token, "expected body expression after nested definition")
 	}
-	return &v
+	return &nestedFnNode{nodeNestedFunction, pos, fn, body}
+}
+
+// parseReturnExpr parses an early return from a function.
+// e.g. def f(x) { if x < 0 then return 0 else 0; sqrt(x) }
+func (p *parser) parseReturnExpr() node {
+	pos := p.token.pos
+	p.next()
+	v := p.parseExpression()
+	if v == nil {
+		return p.error(p.token, "expected expression after 'return'")
+	}
+	return &returnNode{nodeReturn, pos, v}
 }
 
 // parseParenExpr parses expressions offset by parens.
@@ -480,7 +1240,7 @@ func (p *parser) parseParenExpr() node {
 		return nil
 	}
 	if p.token.kind != tokRightParen {
-		return Error(p.token, "expected ')'")
+		return p.error(p.token, "expected ')'")
 	}
 	p.next()
 	return v
@@ -489,27 +1249,178 @@ func (p *parser) parseParenExpr() node {
 // parseNumericExpr parses number literals.
 func (p *parser) parseNumericExpr() node {
 	pos := p.token.pos
-	val, err := strconv.ParseFloat(p.token.val, 64)
+	t := p.token
 	p.next()
+	val, err := strconv.ParseFloat(strings.Replace(t.val, "_", "", -1), 64)
 	if err != nil {
-		return Error(p.token, "invalid number")
+		return p.error(t, "invalid number")
 	}
 	return &numberNode{nodeNumber, pos, val}
 }
 
+// parseIntegerExpr parses integer literals, e.g. 42i or 0xff. Hex
+// literals may use all 64 bits, so 0xffffffffffffffff is -1.
+func (p *parser) parseIntegerExpr() node {
+	pos := p.token.pos
+	t := p.token
+	p.next()
+	digits := strings.Replace(strings.TrimSuffix(t.val, "i"), "_", "", -1)
+	var val int64
+	var err error
+	if hex := strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X"); hex != digits {
+		var u uint64
+		u, err = strconv.ParseUint(hex, 16, 64)
+		val = int64(u)
+	} else {
+		val, err = strconv.ParseInt(digits, 10, 64)
+	}
+	if err != nil {
+		return p.error(t, "invalid integer")
+	}
+	return &integerNode{nodeInteger, pos, val}
+}
+
+// parseRationalExpr parses rational literals of the form "3/4r".
+func (p *parser) parseRationalExpr() node {
+	pos := p.token.pos
+	t := p.token
+	p.next()
+	parts := strings.SplitN(strings.Replace(strings.TrimSuffix(t.val, "r"), "_", "", -1), "/", 2)
+	num, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return p.error(t, "invalid rational numerator")
+	}
+	den, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return p.error(t, "invalid rational denominator")
+	}
+	if den == 0 {
+		return p.error(t, "rational literal has zero denominator")
+	}
+	return &rationalNode{nodeRational, pos, num, den}
+}
+
+// parseStringExpr parses string literals.
+func (p *parser) parseStringExpr() node {
+	pos := p.token.pos
+	t := p.token
+	p.next()
+	val, err := strconv.Unquote(t.val)
+	if err != nil {
+		return p.error(t, "invalid string")
+	}
+	return &stringNode{nodeString, pos, val}
+}
+
+// parseCharExpr parses character literals, e.g. 'A', which are numbers:
+// the character's code point.
+func (p *parser) parseCharExpr() node {
+	pos := p.token.pos
+	t := p.token
+	p.next()
+	r, _, tail, err := strconv.UnquoteChar(t.val[1:len(t.val)-1], '\'')
+	if err != nil || tail != "" {
+		return p.error(t, "invalid character literal")
+	}
+	return &numberNode{nodeNumber, pos, float64(r)}
+}
+
+// parseBoolExpr parses the boolean literals true and false.
+func (p *parser) parseBoolExpr() node {
+	n := &boolNode{nodeBool, p.token.pos, p.token.kind == tokTrue}
+	p.next()
+	return n
+}
+
 // Helper Functions
 
-// Error prints error message and returns a nil node.
-func Error(t token, str string) node {
-	fmt.Fprintf(os.Stderr, "Error at %v: %v\n\tkind:  %v\n\tvalue: %v\n", t.pos, str, t.kind, t.val)
-	// log.Fatalf("Error at %v: %v\n\tkind:  %v\n\tvalue: %v\n", p.pos, str, p.kind, p.val)
+// error reports a syntax error in the current top-level statement,
+// which is abandoned, and returns a nil node. Only the statement's
+// first error is reported; the rest follow from it.
+func (p *parser) error(t token, str string) node {
+	if p.failed {
+		return nil
+	}
+	p.failed = true
+	p.errorToken = t
+	if t.kind == tokError {
+		str = t.val // the lexer knows what's wrong with it
+	}
+	return p.diags.syntaxError(t, str)
+}
+
+// nameError reports that the current token isn't the name expected:
+// specifically, if it's a keyword used as what sort of name, and
+// otherwise with msg.
+func (p *parser) nameError(what, msg string) node {
+	if kind, ok := key[p.token.val]; ok && kind == p.token.kind {
+		return p.error(p.token, fmt.Sprintf("cannot use keyword '%s' as %s", p.token.val, what))
+	}
+	return p.error(p.token, msg)
+}
+
+// syntaxError reports the syntax error str at t and returns a nil node.
+func (l *diagnosticLog) syntaxError(t token, str string) node {
+	if l != nil {
+		l.mu.Lock()
+		l.syntax++
+		l.mu.Unlock()
+	}
+	l.report(Diagnostic{Pos: t.pos, Severity: SeverityError, Message: str},
+		fmt.Sprintf("Error at %v: %v\n\tkind:  %v\n\tvalue: %v\n%s", t.pos, str, t.kind, t.val, sourceContext(t)))
 	return nil
 }
 
-// ErrorV prints the error message and returns a nil llvm.Value.
-func ErrorV(str string) llvm.Value {
-	fmt.Fprintf(os.Stderr, "Error: %v\n", str)
-	return llvm.Value{nil} // TODO: this is wrong; fix it.
+// sourceContext returns the line on which t begins with a caret under
+// t's first character, as the last lines of an error message, or "" if
+// the line isn't known.
+func sourceContext(t token) string {
+	line := strings.TrimRight(t.src, "\r\n")
+	if line == "" || int(t.pos) > len(line) {
+		return ""
+	}
+	// keep tabs so the caret lines up however they're displayed.
+	pad := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, line[:t.pos])
+	return fmt.Sprintf("\t%s\n\t%s^\n", line, pad)
+}
+
+// warning reports a warning, or an error if l promotes warnings to
+// errors.
+func (l *diagnosticLog) warning(str string) {
+	if l != nil && l.werror {
+		l.mu.Lock()
+		l.promoted++
+		l.mu.Unlock()
+		l.report(Diagnostic{Pos: NoPos, Severity: SeverityError, Message: str + " [-Werror]"}, fmt.Sprintf("Error: %v [-Werror]\n", str))
+		return
+	}
+	l.report(Diagnostic{Pos: NoPos, Severity: SeverityWarning, Message: str}, fmt.Sprintf("Warning: %v\n", str))
+}
+
+// errorV reports the error str and returns a nil llvm.Value.
+func (l *diagnosticLog) errorV(str string) llvm.Value {
+	l.report(Diagnostic{Pos: NoPos, Severity: SeverityError, Message: str}, fmt.Sprintf("Error: %v\n", str))
+	return llvm.Value{} // TODO: this is wrong; fix it.
+}
+
+// errorAt reports the error str along with the position of the
+// offending code and returns a nil llvm.Value.
+func (l *diagnosticLog) errorAt(pos Pos, str string) llvm.Value {
+	l.report(Diagnostic{Pos: pos, Severity: SeverityError, Message: str}, fmt.Sprintf("Error at %v: %v\n", pos, str))
+	return llvm.Value{}
+}
+
+// errorCode reports the error str along with its diagnostic code and
+// the position of the offending code, and returns a nil llvm.Value.
+// The code's explanation can be printed with -explain.
+func (l *diagnosticLog) errorCode(code string, pos Pos, str string) llvm.Value {
+	l.report(Diagnostic{Pos: pos, Severity: SeverityError, Code: code, Message: str}, fmt.Sprintf("Error[%v] at %v: %v\n", code, pos, str))
+	return llvm.Value{}
 }
 
 // DumpTree spawns a goroutine to dump incoming AST subtrees and
@@ -0,0 +1,102 @@
+package kaleidoscope
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseOne returns the last top-level statement parsed from src,
+// failing the test if there's none.
+func parseOne(t *testing.T, src string) node {
+	t.Helper()
+	var last node
+	for n := range parse(lexSource("", src, Options{}).Tokens(), Options{}, newPrecedenceTable(nil), nil) {
+		last = n
+	}
+	if last == nil {
+		t.Fatalf("nothing was parsed from %q", src)
+	}
+	return last
+}
+
+// TestPrecedenceOfUserOperator checks that the precedence of anything
+// but a built-in operator is rejected, not ignored.
+func TestPrecedenceOfUserOperator(t *testing.T) {
+	if got, err := ParsePrecedences("+=15, * = 50"); err != nil || !reflect.DeepEqual(got, map[string]int{"+": 15, "*": 50}) {
+		t.Errorf("+=15, * = 50 gave %v, %v", got, err)
+	}
+	if _, err := ParsePrecedences("|=5"); err == nil {
+		t.Errorf("ParsePrecedences accepted the precedence of |")
+	}
+	if _, err := NewEngine(Options{Precedence: map[string]int{"|": 5}}); err == nil {
+		t.Errorf("NewEngine accepted the precedence of |")
+	}
+}
+
+// TestLexErrorRecovery checks that each lexical error is reported, once,
+// and that parsing resumes after it.
+func TestLexErrorRecovery(t *testing.T) {
+	const src = "3.A.8\ndef f(x) x + \"\\q\" + 1\ndef g(x) x @ 2\n)\ndef h(x) 'ab'\ndef ok(x) x\n"
+	diags := &diagnosticLog{quiet: true}
+	var names []string
+	for n := range parse(lexSource("", src, Options{}).Tokens(), Options{}, newPrecedenceTable(nil), diags) {
+		if f, ok := n.(*functionNode); ok {
+			names = append(names, f.proto.(*fnPrototypeNode).name)
+		}
+	}
+	var got []string
+	for _, d := range diags.all() {
+		got = append(got, d.Message)
+	}
+	want := []string{
+		`malformed number "3.A.8"`,
+		`unknown escape sequence in string: \q`,
+		"unrecognized character: U+0040 '@'",
+		"unexpected right paren",
+		"character literal has more than one character",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %q, want %q", got, want)
+	}
+	if wantNames := []string{"g", "ok"}; !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("parsed the definitions %q, want %q", names, wantNames)
+	}
+}
+
+// TestOperatorArityAcrossCalls checks that a user operator defined by
+// one call is still known, with its arity, in the next.
+func TestOperatorArityAcrossCalls(t *testing.T) {
+	e := newTestEngine(t, Options{})
+	check := func(src string) error {
+		return e.Check(Input{"arity.k", strings.NewReader(src)})
+	}
+	if err := check("def unary ! (v) v == 0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("!2"); err != nil {
+		t.Errorf("!2 gave %v", err)
+	}
+	check("1 ! 2")
+	want := "operator ! is declared unary, with 1 operand(s), but is used as a binary operator"
+	if ds := e.Diagnostics(); len(ds) != 1 || ds[0].Message != want {
+		t.Errorf("1 ! 2 gave %v, want %q", ds, want)
+	}
+}
+
+// TestPrecedence checks that Precedence changes how built-in operators
+// group.
+func TestPrecedence(t *testing.T) {
+	for _, tt := range []struct {
+		prec map[string]int
+		want float64
+	}{
+		{nil, 10},
+		{map[string]int{"+": 50}, 14},
+	} {
+		e := newTestEngine(t, Options{Precedence: tt.prec})
+		if got, err := e.Run("2 * 3 + 4"); err != nil || got != tt.want {
+			t.Errorf("with Precedence %v, 2 * 3 + 4 gave %v, %v, want %v", tt.prec, got, err, tt.want)
+		}
+	}
+}
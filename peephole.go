@@ -0,0 +1,79 @@
+package kaleidoscope
+
+import "math"
+
+// Peephole simplifies the AST rooted at n before code generation, e.g.
+// x * 1 → x and if 1 then a else b → a. Unless unsafe is set, only
+// rewrites that preserve floating point semantics exactly are made;
+// with it, x + 0 → x (which turns -0 into +0) and x * 0 → 0 (which is
+// wrong for NaN and infinities) are made too.
+func Peephole(n node, unsafe bool) node {
+	return Rewrite(n, func(n node) node {
+		switch n := n.(type) {
+		case *binaryNode:
+			return peepholeBinary(n, unsafe)
+		case *ifNode:
+			// the condition is true if it's ordered and non-zero.
+			if c, ok := n.ifN.(*numberNode); ok {
+				if c.val != 0 && !math.IsNaN(c.val) {
+					return n.thenN
+				}
+				return n.elseN
+			}
+		}
+		return n
+	})
+}
+
+func peepholeBinary(n *binaryNode, unsafe bool) node {
+	switch {
+	case n.op == "-" && isConst(n.right, 0),
+		n.op == "*" && isConst(n.right, 1),
+		n.op == "/" && isConst(n.right, 1):
+		return n.left
+	case n.op == "*" && isConst(n.left, 1):
+		return n.right
+	case !unsafe:
+		return n
+	case n.op == "+" && isConst(n.right, 0):
+		return n.left
+	case n.op == "+" && isConst(n.left, 0):
+		return n.right
+	case n.op == "*" && isConst(n.right, 0) && isPure(n.left),
+		n.op == "*" && isConst(n.left, 0) && isPure(n.right):
+		return &numberNode{nodeNumber, n.Pos, 0}
+	}
+	return n
+}
+
+// isConst reports whether n is the number literal val.
+func isConst(n node, val float64) bool {
+	c, ok := n.(*numberNode)
+	return ok && c.val == val
+}
+
+// isPure reports whether evaluating n can have no side effects, so it
+// may be dropped. Calls, including to user-defined operators, and
+// assignments may have side effects.
+func isPure(n node) bool {
+	pure := true
+	Walk(n, func(n node) bool {
+		switch n := n.(type) {
+		case *fnCallNode, *nestedFnNode, *returnNode, *incDecNode, *breakNode, *continueNode:
+			pure = false
+		case *unaryNode:
+			pure = n.name == "-" // other unary operators are user-defined
+		case *binaryNode:
+			switch n.op {
+			case "+", "-", "*", "/", "^", "<", ">", "<=", ">=", "==", "!=", "&&", "||":
+			default:
+				pure = false
+			}
+		case *forNode, *whileNode, *doWhileNode, *variableExprNode, *blockNode:
+			// loops may not terminate; declarations may be assigned.
+			pure = false
+		}
+		return pure
+	})
+	return pure
+}
@@ -0,0 +1,36 @@
+package kaleidoscope
+
+import "testing"
+
+func TestPeephole(t *testing.T) {
+	for _, tt := range []struct {
+		src          string
+		safe, unsafe string // the rewritten expression, formatted
+	}{
+		{"x - 0", "x", "x"},
+		{"x * 1", "x", "x"},
+		{"x / 1", "x", "x"},
+		{"1 * x", "x", "x"},
+		{"x * 1 - 0", "x", "x"},
+		{"x + 0", "x + 0", "x"},
+		{"0 + x", "0 + x", "x"},
+		{"x * 0", "x * 0", "0"},
+		{"0 * x", "0 * x", "0"},
+		{"f(x) * 0", "f(x) * 0", "f(x) * 0"},
+		{"0 * (x = 1)", "0 * (x = 1)", "0 * (x = 1)"},
+		{"if 1 then 2 else 3", "2", "2"},
+		{"if 0 then 2 else 3", "3", "3"},
+		{"if x then 2 else 3", "if x then 2 else 3", "if x then 2 else 3"},
+	} {
+		n := parseOne(t, tt.src)
+		for _, unsafe := range []bool{false, true} {
+			want := tt.safe
+			if unsafe {
+				want = tt.unsafe
+			}
+			if got := Format(Peephole(n, unsafe)); got != want {
+				t.Errorf("%s with unsafe %v became %s, want %s", tt.src, unsafe, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Profile records the time spent working in each stage of the
+// pipeline. Each stage runs in its own goroutine and only writes its
+// own field before closing its output channel, so a Profile is safe to
+// read once Engine.Interpret has returned.
+type Profile struct {
+	Optimize time.Duration // setting up the optimization passes
+	Lex      time.Duration
+	Parse    time.Duration
+	Codegen  time.Duration // includes the function pass manager
+	Exec     time.Duration
+}
+
+// Report writes a summary table of the profile to w.
+func (p *Profile) Report(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "stage\ttime\t")
+	fmt.Fprintf(tw, "optimize setup\t%v\t\n", p.Optimize)
+	fmt.Fprintf(tw, "lex\t%v\t\n", p.Lex)
+	fmt.Fprintf(tw, "parse\t%v\t\n", p.Parse)
+	fmt.Fprintf(tw, "codegen\t%v\t\n", p.Codegen)
+	fmt.Fprintf(tw, "exec\t%v\t\n", p.Exec)
+	fmt.Fprintf(tw, "total\t%v\t\n", p.Optimize+p.Lex+p.Parse+p.Codegen+p.Exec)
+	tw.Flush()
+}
+
+// stopwatch accumulates the time between calls to start and stop into
+// total. Stages stop their stopwatch while blocked on their neighbours
+// so that only time spent working is counted. The zero stopwatch does
+// nothing, which is what we want when profiling is off.
+type stopwatch struct {
+	total *time.Duration
+	began time.Time
+}
+
+func (s *stopwatch) start() {
+	if s.total != nil {
+		s.began = time.Now()
+	}
+}
+
+func (s *stopwatch) stop() {
+	if s.total != nil {
+		*s.total += time.Since(s.began)
+	}
+}
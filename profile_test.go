@@ -0,0 +1,30 @@
+package kaleidoscope
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProfile checks that the profile times all four stages of a run
+// and that its summary lists them.
+func TestProfile(t *testing.T) {
+	p := &Profile{}
+	e := newTestEngine(t, Options{Profile: p})
+	if _, err := e.Run("def profiled(x) x * 2; profiled(21)"); err != nil {
+		t.Fatal(err)
+	}
+	for stage, d := range map[string]time.Duration{"lex": p.Lex, "parse": p.Parse, "codegen": p.Codegen, "exec": p.Exec} {
+		if d <= 0 {
+			t.Errorf("no time was spent in %s", stage)
+		}
+	}
+	var b bytes.Buffer
+	p.Report(&b)
+	for _, stage := range []string{"lex", "parse", "codegen", "exec"} {
+		if !strings.Contains(b.String(), stage+" ") {
+			t.Errorf("the summary has no %s:\n%s", stage, b.String())
+		}
+	}
+}
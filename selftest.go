@@ -0,0 +1,142 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"io"
+)
+
+// selfTests are small programs that exercise the compiler and JIT end
+// to end, along with the value their last expression should produce.
+// Function names are prefixed so as not to clash with user programs.
+var selfTests = []struct {
+	name string
+	src  string
+	want float64
+}{
+	{"arithmetic", "2 - 1 * (2 - (5 + 5) * 2) / 0.5", 38},
+	{"loop", "var s = 0 in (for i = 1, i < 5 in s = s + i) + s", 15},
+	{"recursion", "def selftestfib(x) if x < 3 then 1 else selftestfib(x-1) + selftestfib(x-2); selftestfib(20)", 6765},
+	{"extern", "extern cos(x); cos(0)", 1},
+	{"integer", "7i / 2i", 3},
+	{"statements on one line", "def selftestid(x) x; selftestid(3); selftestid(4)", 4},
+	{"no final newline", "1 + 2 # the source ends here, without a newline", 3},
+}
+
+// selfTestErrors are programs along with the number of syntax errors
+// each should report: one per mistake, not a cascade, and none for a
+// program without statements.
+var selfTestErrors = []struct {
+	name   string
+	src    string
+	errors int
+}{
+	{"definition without a name", "def (x) x", 1},
+	{"keyword as a function name", "def for(x) x", 1},
+	{"keyword as an argument name", "def selftesttwice(then) 2 * then", 1},
+	{"keyword as a variable name", "var var = 1 in 2", 1},
+	{"empty input", "", 0},
+	{"only comments", "  # nothing here\n#{ nor\n   here }#\n", 0},
+}
+
+// formatSample uses every kind of statement and expression, to test
+// that formatting a tree and parsing the result gives the same tree.
+const formatSample = `
+def binary | 5 (a, b) if a then 1 else if b then 1 else 0
+def unary ! (v) v == 0
+extern llabs(n: int): int
+enum Shade { Light, Dark = 4, Darker }
+var total = 0, cells[4]
+def clamp(x) x < 0 ? -x : x > 9 ? 9 : x
+def mix(x, y) { var a = x; a += y * 2; cells[1] = a - -y; ++a; a-- }
+def loops(n) var acc = 1 in (for i = 1, i < n, 2 in acc = acc * i yielding acc) + (while acc > 100 in acc = acc / 2)
+def more(n) { do { n++; if n > 5 then break else continue } while n < 10; return n }
+def nest(k) def scale(x) x * k in scale(2) + (var f = \(a, b) a - b in f(1, 2))
+discard !(1 | 0) + 2 ^ 3 ^ 2 - (2 ^ 3) ^ 2 - (1 - 2) - 3;
+-(1 + 2) * 'A' / 3/4r + 42i + 0xff + 1e300 + 1.5
+"say \"hi\"\n"; true; false
+(def twice(x) 2 * x in twice(3))
+`
+
+// roundTrip parses src, formats the statements and parses the result,
+// returning an error if the trees differ.
+func roundTrip(src string) error {
+	parseAll := func(src string) ([]node, map[string]int) {
+		prec := newPrecedenceTable(nil)
+		var nodes []node
+		for n := range parse(lexSource("", src, Options{}).Tokens(), Options{}, prec, nil) {
+			nodes = append(nodes, n)
+		}
+		return nodes, prec.copy()
+	}
+	before, prec := parseAll(src)
+	formatted := formatProgram(before, prec)
+	after, _ := parseAll(formatted)
+	if len(after) != len(before) {
+		return fmt.Errorf("%d statements became %d in:\n%s", len(before), len(after), formatted)
+	}
+	for i := range before {
+		if memoKey(before[i]) != memoKey(after[i]) {
+			return fmt.Errorf("statement %d changed: %s", i+1, Format(after[i]))
+		}
+	}
+	return nil
+}
+
+// SelfTest runs the built-in smoke tests, writing a line per test to w.
+// It reports whether every test passed.
+func (e *Engine) SelfTest(w io.Writer) bool {
+	ok := true
+	for _, t := range selfTests {
+		got, err := e.Run(t.src)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "FAIL %s: %v\n", t.name, err)
+			ok = false
+		case got != t.want:
+			fmt.Fprintf(w, "FAIL %s: got %v, want %v\n", t.name, got, t.want)
+			ok = false
+		default:
+			fmt.Fprintf(w, "PASS %s\n", t.name)
+		}
+	}
+	for _, t := range selfTests {
+		if err := roundTrip(t.src); err != nil {
+			fmt.Fprintf(w, "FAIL formatting %s: %v\n", t.name, err)
+			ok = false
+		}
+	}
+	if err := roundTrip(formatSample); err != nil {
+		fmt.Fprintf(w, "FAIL formatting: %v\n", err)
+		ok = false
+	} else {
+		fmt.Fprintf(w, "PASS formatting\n")
+	}
+	if e.opts.StackGuard > 0 {
+		_, err := e.Run("def selftestforever(x) selftestforever(x + 1); selftestforever(0)")
+		if err == nil {
+			fmt.Fprintf(w, "FAIL stack guard: runaway recursion didn't fail\n")
+			ok = false
+		} else if got, err := e.Run("selftestfib(10)"); err != nil || got != 55 {
+			fmt.Fprintf(w, "FAIL stack guard: got %v, %v after the guard tripped, want 55\n", got, err)
+			ok = false
+		} else {
+			fmt.Fprintf(w, "PASS stack guard\n")
+		}
+	}
+	for _, t := range selfTestErrors {
+		e.Run(t.src) // the errors are printed to stderr
+		got := 0
+		for _, d := range e.Diagnostics() {
+			if d.Severity == SeverityError {
+				got++
+			}
+		}
+		if got != t.errors {
+			fmt.Fprintf(w, "FAIL %s: got %d syntax error(s), want %d\n", t.name, got, t.errors)
+			ok = false
+		} else {
+			fmt.Fprintf(w, "PASS %s\n", t.name)
+		}
+	}
+	return ok
+}
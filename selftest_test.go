@@ -0,0 +1,13 @@
+package kaleidoscope
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	var out bytes.Buffer
+	if !newTestEngine(t, Options{StackGuard: 10000}).SelfTest(&out) {
+		t.Errorf("the self-test failed:\n%s", out.String())
+	}
+}
@@ -0,0 +1,63 @@
+package kaleidoscope
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/ajsnow/llvm"
+)
+
+// Stats counts the code generated for a program, before and after the
+// function passes ran.
+type Stats struct {
+	Functions    int // functions with bodies, including top-level expressions
+	Declarations int // extern functions
+
+	UnoptBlocks, Blocks             int
+	UnoptInstructions, Instructions int
+}
+
+// addUnopt counts f, a newly generated function, before optimization.
+func (s *Stats) addUnopt(f llvm.Value) {
+	blocks, instrs := countCode(f)
+	s.UnoptBlocks += blocks
+	s.UnoptInstructions += instrs
+}
+
+// count walks m, counting the functions, blocks and instructions in it.
+func (s *Stats) count(m llvm.Module) {
+	for f := m.FirstFunction(); !f.IsNil(); f = f.NextFunction() {
+		if f.BasicBlocksCount() == 0 {
+			s.Declarations++
+			continue
+		}
+		blocks, instrs := countCode(f)
+		s.Functions++
+		s.Blocks += blocks
+		s.Instructions += instrs
+	}
+}
+
+// countCode returns the number of basic blocks and instructions in f.
+func countCode(f llvm.Value) (blocks, instrs int) {
+	blocks = f.BasicBlocksCount()
+	bb := f.FirstBasicBlock()
+	for i := 0; i < blocks; i++ {
+		for in := bb.FirstInstruction(); !in.IsNil(); in = in.NextInstruction() {
+			instrs++
+		}
+		bb = bb.NextBasicBlock()
+	}
+	return blocks, instrs
+}
+
+// Report writes a summary table of the statistics to w.
+func (s *Stats) Report(w io.Writer) {
+	fmt.Fprintf(w, "%d functions defined, %d declared\n", s.Functions, s.Declarations)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tgenerated\toptimized\teliminated\t")
+	fmt.Fprintf(tw, "blocks\t%d\t%d\t%d\t\n", s.UnoptBlocks, s.Blocks, s.UnoptBlocks-s.Blocks)
+	fmt.Fprintf(tw, "instructions\t%d\t%d\t%d\t\n", s.UnoptInstructions, s.Instructions, s.UnoptInstructions-s.Instructions)
+	tw.Flush()
+}
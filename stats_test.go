@@ -0,0 +1,14 @@
+package kaleidoscope
+
+import "testing"
+
+// TestStats checks that the functions and instructions generated for a
+// program are counted.
+func TestStats(t *testing.T) {
+	var stats Stats
+	e := newTestEngine(t, Options{Stats: &stats})
+	interpret(t, e, "stats.k", "def counted(x) x + 1")
+	if stats.Functions == 0 || stats.Instructions == 0 {
+		t.Errorf("got %d functions and %d instructions, want some of each", stats.Functions, stats.Instructions)
+	}
+}